@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// readValue returns s, or the trimmed contents of the named file if s
+// starts with "@", following the Vault CLI convention.
+func readValue(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(s[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// login authenticates client using the method named by cfg.Auth, setting
+// the resulting token on client.  An empty method means the token from
+// the environment is used as-is.
+func login(client *api.Client, cfg Config) error {
+	switch cfg.Auth {
+	case "", "token":
+		return nil
+	case "approle":
+		return loginAppRole(client, cfg)
+	case "aws":
+		return loginAWS(client, cfg)
+	case "cert":
+		return loginCert(client, cfg)
+	default:
+		return fmt.Errorf("unsupported auth method: %q", cfg.Auth)
+	}
+}
+
+func loginAppRole(client *api.Client, cfg Config) error {
+	roleID, err := readValue(cfg.RoleID)
+	if err != nil {
+		return err
+	}
+	secretID, err := readValue(cfg.SecretID)
+	if err != nil {
+		return err
+	}
+	if roleID == "" {
+		return fmt.Errorf("approle auth requires a role ID")
+	}
+
+	vc := &vaultapi{Client: client, logger: cfg.Logger, retries: cfg.Retries, failover: newFailover(cfg.Addresses)}
+	sec, err := vc.Logical().Write(context.Background(), "auth/approle/login", map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("approle login failed: %v", err)
+	}
+	return setAuthToken(client, sec)
+}
+
+// loginCert logs in with the cert auth method, which authenticates us by
+// the TLS client certificate configured for client.
+func loginCert(client *api.Client, cfg Config) error {
+	vc := &vaultapi{Client: client, logger: cfg.Logger, retries: cfg.Retries, failover: newFailover(cfg.Addresses)}
+	sec, err := vc.Logical().Write(context.Background(), "auth/cert/login", map[string]interface{}{})
+	if err != nil {
+		return fmt.Errorf("cert login failed: %v", err)
+	}
+	return setAuthToken(client, sec)
+}
+
+// tokenFileInterval is how often token and credential files are checked
+// for changes.
+var tokenFileInterval = 5 * time.Second
+
+// setToken sets the token used by f and by the FSes of the child
+// namespaces created from it.
+func (f *FS) setToken(token string) {
+	f.client.SetToken(token)
+	f.mu.Lock()
+	children := make([]*FS, 0, len(f.namespaces))
+	for _, child := range f.namespaces {
+		children = append(children, child)
+	}
+	f.mu.Unlock()
+	for _, child := range children {
+		child.setToken(token)
+	}
+}
+
+// watchTokenFile re-reads the token file at path every interval until ctx
+// is done, switching to the token it holds whenever that changes, e.g.
+// because a "vault login" rewrote ~/.vault-token.
+func (f *FS) watchTokenFile(ctx context.Context, path string, interval time.Duration) {
+	current := f.client.Token()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		token, err := readValue("@" + path)
+		if err != nil {
+			f.cfg.Logger.Warn("reading token file failed", "path", path, "error", err)
+			continue
+		}
+		if token == "" || token == current {
+			continue
+		}
+		f.setToken(token)
+		current = token
+		f.cfg.Logger.Info("token file changed, using new token", "path", path)
+	}
+}
+
+// credentialFiles returns the files that the credentials of cfg.Auth are
+// read from, if any.
+func credentialFiles(cfg Config) []string {
+	var files []string
+	switch cfg.Auth {
+	case "approle":
+		for _, v := range []string{cfg.RoleID, cfg.SecretID} {
+			if strings.HasPrefix(v, "@") {
+				files = append(files, v[1:])
+			}
+		}
+	case "cert":
+		cert, key := cfg.ClientCert, cfg.ClientKey
+		if cert == "" {
+			cert, key = os.Getenv(api.EnvVaultClientCert), os.Getenv(api.EnvVaultClientKey)
+		}
+		for _, file := range []string{cert, key} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// watchCredentials re-reads the credential files every interval until ctx
+// is done, logging in again whenever they change, e.g. because a SecretID
+// or client certificate was rotated.  The old token stays in use until
+// the new login succeeds; a failed one is retried every interval.  The
+// new certificate is only used to log in: other requests keep presenting
+// the one loaded at mount.
+func (f *FS) watchCredentials(ctx context.Context, files []string, interval time.Duration) {
+	read := func() ([][]byte, error) {
+		contents := make([][]byte, len(files))
+		for i, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			contents[i] = b
+		}
+		return contents, nil
+	}
+	current, _ := read()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		contents, err := read()
+		if err != nil {
+			f.cfg.Logger.Warn("reading credentials failed", "error", err)
+			continue
+		}
+		changed := false
+		for i := range contents {
+			if current == nil || !bytes.Equal(contents[i], current[i]) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := f.relogin(); err != nil {
+			f.cfg.Logger.Warn("credentials changed, but logging in with them failed; keeping the current token", "error", err)
+			continue
+		}
+		current = contents
+		f.cfg.Logger.Info("credentials changed, logged in again", "auth", f.cfg.Auth)
+	}
+}
+
+// relogin logs in afresh using a client of its own, so that f keeps
+// working with the current token until there's a new one to switch to.
+func (f *FS) relogin() error {
+	vcfg, err := apiConfig(f.cfg)
+	if err != nil {
+		return err
+	}
+	client, err := api.NewClient(vcfg)
+	if err != nil {
+		return err
+	}
+	if err := client.SetAddress(f.client.Address()); err != nil {
+		return err
+	}
+	client.SetHeaders(f.client.Headers())
+	client.SetMaxRetries(0)
+	if err := login(client, f.cfg); err != nil {
+		return err
+	}
+	f.setToken(client.Token())
+	return nil
+}
+
+// setAuthToken sets the client token from the auth info of a login
+// response.
+func setAuthToken(client *api.Client, sec *api.Secret) error {
+	if sec == nil || sec.Auth == nil || sec.Auth.ClientToken == "" {
+		return fmt.Errorf("login response contained no token")
+	}
+	client.SetToken(sec.Auth.ClientToken)
+	return nil
+}
+
+// renewToken periodically renews the client's token until ctx is done.
+// Renewal happens every interval, or at half the token's TTL if interval
+// is zero.  It returns an error once the token can no longer be kept
+// alive, and nil if the token doesn't expire.
+func renewToken(ctx context.Context, client *vaultapi, interval time.Duration) error {
+	sec, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return fmt.Errorf("looking up token: %v", err)
+	}
+	ttl, err := sec.TokenTTL()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return nil
+	}
+	expiry := time.Now().Add(ttl)
+
+	for {
+		wait := interval
+		if wait == 0 {
+			wait = ttl / 2
+		}
+		if remaining := time.Until(expiry); wait > remaining {
+			wait = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		sec, err := client.Auth().Token().RenewSelf(0)
+		if err == nil {
+			ttl, err = sec.TokenTTL()
+		}
+		if err != nil {
+			if time.Now().After(expiry) {
+				return fmt.Errorf("token expired, last renewal error: %v", err)
+			}
+			client.logger.Warn("token renewal failed, will retry", "error", err)
+			ttl = time.Until(expiry)
+			continue
+		}
+		expiry = time.Now().Add(ttl)
+	}
+}
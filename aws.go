@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// awsCreds are AWS credentials, as found in the environment or fetched
+// from the ECS or EC2 metadata endpoints.
+type awsCreds struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+// The endpoints credentials are fetched from when not in the environment.
+// They're variables so that tests can point them elsewhere.
+var (
+	ecsCredsURL = "http://169.254.170.2"
+	ec2MetaURL  = "http://169.254.169.254/latest"
+)
+
+// stsRequest is the request Vault's aws auth method has AWS answer to
+// establish who we are.
+const (
+	stsURL    = "https://sts.amazonaws.com/"
+	stsRegion = "us-east-1"
+	stsBody   = "Action=GetCallerIdentity&Version=2011-06-15"
+)
+
+// loginAWS logs in with the iam flavour of the aws auth method, proving
+// our identity with a signed sts:GetCallerIdentity request for Vault to
+// make on our behalf.
+func loginAWS(client *api.Client, cfg Config) error {
+	ctx := context.Background()
+	creds, err := awsCredentials(ctx)
+	if err != nil {
+		return fmt.Errorf("aws login failed: %v", err)
+	}
+	req, err := http.NewRequest("POST", stsURL, strings.NewReader(stsBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, []byte(stsBody), creds, stsRegion, "sts", time.Now())
+	headers, err := json.Marshal(req.Header)
+	if err != nil {
+		return err
+	}
+
+	vc := &vaultapi{Client: client, logger: cfg.Logger, retries: cfg.Retries, failover: newFailover(cfg.Addresses)}
+	sec, err := vc.Logical().Write(ctx, "auth/aws/login", map[string]interface{}{
+		"role":                    cfg.AWSRole,
+		"iam_http_request_method": req.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(stsURL)),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(stsBody)),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+	})
+	if err != nil {
+		return fmt.Errorf("aws login failed: %v", err)
+	}
+	return setAuthToken(client, sec)
+}
+
+// awsCredentials returns the credentials in the environment if set, else
+// those of the ECS task role, else those of the EC2 instance profile.
+func awsCredentials(ctx context.Context) (awsCreds, error) {
+	creds := awsCreds{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		err := getJSON(ctx, ecsCredsURL+uri, nil, &creds)
+		return creds, err
+	}
+
+	// IMDSv2 wants a session token, but fall back to IMDSv1 without one.
+	var header http.Header
+	req, err := http.NewRequest("PUT", ec2MetaURL+"/api/token", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if b, err := doMetadata(ctx, req); err == nil {
+		header = http.Header{"X-Aws-Ec2-Metadata-Token": {string(b)}}
+	}
+	req, err = http.NewRequest("GET", ec2MetaURL+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return creds, err
+	}
+	req.Header = header
+	b, err := doMetadata(ctx, req)
+	if err != nil {
+		return creds, fmt.Errorf("no AWS credentials in the environment or instance metadata: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	err = getJSON(ctx, ec2MetaURL+"/meta-data/iam/security-credentials/"+role, header, &creds)
+	return creds, err
+}
+
+// metadataClient fetches credentials, failing fast when not on AWS.
+var metadataClient = &http.Client{Timeout: 5 * time.Second}
+
+// doMetadata performs req and returns the response body, which must have
+// a 200 status.
+func doMetadata(ctx context.Context, req *http.Request) ([]byte, error) {
+	resp, err := metadataClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// getJSON fetches url with the given headers and decodes the response
+// into v.
+func getJSON(ctx context.Context, url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	b, err := doMetadata(ctx, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// signV4 signs req, whose body is body, with AWS Signature Version 4 for
+// the given region and service.  All headers already set on req are
+// signed, along with the Host header.
+func signV4(req *http.Request, body []byte, creds awsCreds, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(vs, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// Encode turns spaces into "+", which AWS wants as "%20".
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonHeaders.String(),
+		signed,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonical))
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, sig))
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := awsCreds{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestAWSLogin(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	var body map[string]string
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/aws/login" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"s.aws"}}`))
+	})
+	defer cleanup()
+
+	if err := login(client.Client, Config{Auth: "aws", AWSRole: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Token(); got != "s.aws" {
+		t.Errorf("got token %q", got)
+	}
+	if body["role"] != "web" || body["iam_http_request_method"] != "POST" {
+		t.Errorf("got login request %v", body)
+	}
+	b, err := base64.StdEncoding.DecodeString(body["iam_request_headers"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers http.Header
+	if err := json.Unmarshal(b, &headers); err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Authorization") == "" || headers.Get("X-Amz-Security-Token") != "session" {
+		t.Errorf("got signed headers %v", headers)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/hashicorp/hcl"
+)
+
+// loadConfigFile applies the settings in the JSON or HCL file at path to
+// the flags in fset of the same name.  Flags given on the command line take
+// precedence over the file, so it must be called after fset is parsed.
+func loadConfigFile(fset *flag.FlagSet, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]interface{}
+	if err := hcl.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fset.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		// A list sets the flag once per element, as if it were repeated.
+		values, ok := settings[name].([]interface{})
+		if !ok {
+			values = []interface{}{settings[name]}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, bool, int, int64, float64:
+				if err := fset.Set(name, fmt.Sprint(v)); err != nil {
+					return fmt.Errorf("%s: %s: %v", path, name, err)
+				}
+			default:
+				return fmt.Errorf("%s: %s: unsupported value of type %T", path, name, v)
+			}
+		}
+	}
+	return nil
+}
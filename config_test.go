@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultfuseconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hclPath := filepath.Join(dir, "fusevault.hcl")
+	jsonPath := filepath.Join(dir, "fusevault.json")
+	badPath := filepath.Join(dir, "bad.json")
+	for path, content := range map[string]string{
+		hclPath:  "auth = \"approle\"\ncache-ttl = \"1m\"\nfields = true\n",
+		jsonPath: `{"auth": "approle", "cache-ttl": "1m", "fields": true}`,
+		badPath:  `{"cache-tll": "1m"}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newFlags := func(args ...string) (*flag.FlagSet, *string, *time.Duration, *bool) {
+		fset := flag.NewFlagSet("test", flag.ContinueOnError)
+		auth := fset.String("auth", "", "")
+		ttl := fset.Duration("cache-ttl", 5*time.Second, "")
+		fields := fset.Bool("fields", false, "")
+		if err := fset.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fset, auth, ttl, fields
+	}
+
+	for _, path := range []string{hclPath, jsonPath} {
+		fset, auth, ttl, fields := newFlags("-cache-ttl", "2s")
+		if err := loadConfigFile(fset, path); err != nil {
+			t.Fatal(err)
+		}
+		if *auth != "approle" || *ttl != 2*time.Second || !*fields {
+			t.Errorf("%s: got auth=%q cache-ttl=%v fields=%v", path, *auth, *ttl, *fields)
+		}
+	}
+
+	fset, _, _, _ := newFlags()
+	err = loadConfigFile(fset, badPath)
+	if err == nil || !strings.Contains(err.Error(), `unknown setting "cache-tll"`) {
+		t.Fatalf("got %v, want unknown setting error", err)
+	}
+}
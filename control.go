@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+)
+
+// defaultReservedPrefix is the default Config.ReservedPrefix, chosen to be
+// unlikely to clash with the names of mounts and secrets.
+const defaultReservedPrefix = "@vault."
+
+// controlFiles are the reserved names looked up in the root directory
+// ahead of mounts, mapped to the functions making their nodes.  They aren't
+// listed, so as not to clutter the root.
+var controlFiles = map[string]func(*RootDir) fs.Node{
+	"flush":  newFlushFile,
+	"leases": leasesDir,
+	"raw":    rawDir,
+	"token":  tokenFile,
+	"unwrap": unwrapFile,
+}
+
+// mountFiles are the reserved names looked up at the top of each mount
+// ahead of its secrets.  Like controlFiles they aren't listed.
+var mountFiles = map[string]func(*MountDir) (fs.Node, error){
+	"mount": (*MountDir).mountInfo,
+}
+
+// reserved returns the registered name that name, as looked up, stands
+// for if it has the reserved prefix.
+func (f *FS) reserved(name string) (string, bool) {
+	if !strings.HasPrefix(name, f.cfg.ReservedPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, f.cfg.ReservedPrefix), true
+}
+
+// unwrapFile returns the file which unwraps response-wrapping tokens
+// written to it, making the unwrapped response readable from it.
+func unwrapFile(d *RootDir) fs.Node {
+	f := d.fs
+	return f.opFile("sys/wrapping/unwrap", func(ctx context.Context, in []byte) ([]byte, error) {
+		token := strings.TrimSpace(string(in))
+		if token == "" {
+			return nil, fuse.Errno(syscall.EINVAL)
+		}
+		sec, err := f.client.Logical().Unwrap(ctx, token)
+		if err != nil {
+			return nil, errno(err)
+		}
+		if sec == nil {
+			return nil, fuse.ENOENT
+		}
+		return f.marshal(sec)
+	})
+}
+
+// tokenFile returns the file describing the token in use, as looked up
+// afresh on each open so that its remaining TTL is current.  The token
+// itself is redacted.
+func tokenFile(d *RootDir) fs.Node {
+	f := d.fs
+	return &liveFile{
+		fs:   f,
+		path: "\x00token",
+		fetch: func(ctx context.Context) ([]byte, error) {
+			sec, err := f.client.Logical().Read(ctx, "auth/token/lookup-self")
+			if err != nil {
+				return nil, errno(err)
+			}
+			if sec == nil || sec.Data == nil {
+				return nil, fuse.ENOENT
+			}
+			if _, ok := sec.Data["id"]; ok {
+				sec.Data["id"] = "redacted"
+			}
+			return f.marshal(sec.Data)
+		},
+	}
+}
+
+// lookupWrapped returns a file which, each time it's opened, holds a new
+// response-wrapping token for the secret at relpath, so that it can be
+// handed to another process to unwrap.
+func lookupWrapped(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	path := filepath.Join(d.mountpt, d.pathread(relpath))
+	return &liveFile{
+		fs:   d.fs,
+		path: siblingPath(d, relpath, "wrapped"),
+		fetch: func(ctx context.Context) ([]byte, error) {
+			sec, err := d.fs.client.Logical().ReadWrapped(ctx, path, d.fs.cfg.WrapTTL)
+			if err != nil {
+				return nil, errno(err)
+			}
+			if sec == nil || sec.WrapInfo == nil {
+				return nil, fuse.ENOENT
+			}
+			return []byte(sec.WrapInfo.Token), nil
+		},
+		unsized: true,
+	}, nil
+}
+
+// flushFile is a write-only file, any write to which drops everything
+// cached, for when secrets are known to have changed behind our back.
+type flushFile struct {
+	root *RootDir
+}
+
+func newFlushFile(d *RootDir) fs.Node {
+	return &flushFile{root: d}
+}
+
+var _ fs.Node = (*flushFile)(nil)
+
+func (fl *flushFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	fl.root.fs.fileAttr(a, "\x00flush", 0222)
+	return nil
+}
+
+var _ fs.NodeOpener = (*flushFile)(nil)
+
+func (fl *flushFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	if !req.Flags.IsWriteOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return fl, nil
+}
+
+var _ fs.HandleWriter = (*flushFile)(nil)
+
+func (fl *flushFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	fl.root.fs.flush()
+	if _, err := fl.root.refresh(ctx); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// flush drops the cached lists, secrets, failed lookups and entry counts
+// of f and its child namespaces.
+func (f *FS) flush() {
+	f.lists.clear()
+	f.secrets.clear()
+	f.missing.clear()
+	f.mu.Lock()
+	f.counts = make(map[string]int)
+	children := make([]*FS, 0, len(f.namespaces))
+	for _, child := range f.namespaces {
+		children = append(children, child)
+	}
+	f.mu.Unlock()
+	for _, child := range children {
+		child.flush()
+	}
+}
+
+// An opFunc computes the content to be read back from an opFile, given
+// what was written to it.
+type opFunc func(ctx context.Context, in []byte) ([]byte, error)
+
+// opFile is a file that runs an operation on the content written to it
+// when the writing handle is flushed, after which the operation's result
+// can be read back.
+type opFile struct {
+	fs   *FS
+	path string
+	op   opFunc
+
+	mu      sync.Mutex
+	in      []byte
+	writing bool
+	out     []byte
+}
+
+// opFile returns the opFile for key, the Vault path it operates on,
+// creating it with op if need be.
+// These are kept for the life of the FS so that the result of an
+// operation remains readable even if the kernel looks the file up again.
+func (f *FS) opFile(key string, op opFunc) *opFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o, ok := f.opFiles[key]; ok {
+		return o
+	}
+	o := &opFile{fs: f, path: key, op: op}
+	f.opFiles[key] = o
+	return o
+}
+
+var _ fs.Node = (*opFile)(nil)
+
+func (o *opFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	o.fs.fileAttr(a, o.path, 0644)
+	o.mu.Lock()
+	a.Size = uint64(len(o.out))
+	o.mu.Unlock()
+	return nil
+}
+
+var _ fs.NodeOpener = (*opFile)(nil)
+
+func (o *opFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	// The content changes with each operation, so bypass the page cache.
+	resp.Flags |= fuse.OpenDirectIO
+	if !req.Flags.IsReadOnly() {
+		o.mu.Lock()
+		o.in = nil
+		o.writing = true
+		o.mu.Unlock()
+	}
+	return o, nil
+}
+
+var _ fs.NodeSetattrer = (*opFile)(nil)
+
+// Setattr accepts truncation so that shell redirection works; the input
+// is replaced on each open for writing anyway.
+func (o *opFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return o.Attr(ctx, &resp.Attr)
+}
+
+var _ fs.HandleReader = (*opFile)(nil)
+
+func (o *opFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fuseutil.HandleRead(req, resp, o.out)
+	return nil
+}
+
+var _ fs.HandleWriter = (*opFile)(nil)
+
+func (o *opFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	end := int(req.Offset) + len(req.Data)
+	if end > len(o.in) {
+		o.in = resize(o.in, end)
+	}
+	copy(o.in[req.Offset:], req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ fs.HandleFlusher = (*opFile)(nil)
+
+func (o *opFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.writing {
+		return nil
+	}
+	o.writing = false
+	out, err := o.op(ctx, o.in)
+	o.in = nil
+	if err != nil {
+		return err
+	}
+	o.out = out
+	return nil
+}
+
+// liveFile is a read-only file whose content is fetched anew each time
+// it's opened, for presenting state that changes independently of the
+// filesystem.
+type liveFile struct {
+	fs    *FS
+	path  string
+	fetch func(ctx context.Context) ([]byte, error)
+	// unsized is set if fetching has side effects, so shouldn't be done
+	// just to report the size, which is then zero.  The content is read
+	// with direct I/O, so it's served in full regardless.
+	unsized bool
+}
+
+var _ fs.Node = (*liveFile)(nil)
+
+func (l *liveFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	l.fs.fileAttr(a, l.path, 0444)
+	if l.unsized {
+		return nil
+	}
+	b, err := l.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	a.Size = uint64(len(b))
+	return nil
+}
+
+var _ fs.NodeOpener = (*liveFile)(nil)
+
+func (l *liveFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	b, err := l.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return liveHandle(b), nil
+}
+
+// liveHandle serves the content fetched when a liveFile was opened.
+type liveHandle []byte
+
+var _ fs.HandleReader = liveHandle(nil)
+
+func (h liveHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fuseutil.HandleRead(req, resp, h)
+	return nil
+}
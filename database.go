@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makeDatabaseNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &DatabaseDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// makeAwsNode presents an aws mount, whose roles and the credentials they
+// issue are laid out as a database mount's.
+func makeAwsNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return makeDatabaseNode(f, mountpt, mount)
+}
+
+// DatabaseDir presents a database mount, or another whose roles are
+// listed under roles and issue credentials under creds, such as an aws
+// mount.  It holds a creds directory with a file per role, each read of
+// which issues new credentials.
+type DatabaseDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+var _ fs.Node = (*DatabaseDir)(nil)
+
+func (d *DatabaseDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*DatabaseDir)(nil)
+
+func (d *DatabaseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{d.fs.dirent("creds", fuse.DT_Dir, filepath.Join(d.mountpt, "creds"))}, nil
+}
+
+var _ fs.NodeStringLookuper = (*DatabaseDir)(nil)
+
+func (d *DatabaseDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "creds" {
+		return &DatabaseCredsDir{d}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// DatabaseCredsDir lists the roles of a database mount.
+type DatabaseCredsDir struct {
+	*DatabaseDir
+}
+
+func (d *DatabaseCredsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, "creds"), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*DatabaseCredsDir)(nil)
+
+func (d *DatabaseCredsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, filepath.Join(d.mountpt, "roles"), filepath.Join(d.mountpt, "creds"))
+}
+
+var _ fs.NodeStringLookuper = (*DatabaseCredsDir)(nil)
+
+// Lookup checks that the role exists without issuing credentials, which
+// is left to Open so that a stat doesn't create a lease.
+func (d *DatabaseCredsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	role, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	sec, err := d.fs.client.Logical().Read(ctx, filepath.Join(d.mountpt, "roles", role))
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		return nil, fuse.ENOENT
+	}
+	return &credsFile{fs: d.fs, path: filepath.Join(d.mountpt, "creds", role)}, nil
+}
+
+// credsFile is a read-only file holding credentials newly issued by a
+// dynamic secrets engine each time it's opened; they're never cached.
+// The lease of the last credentials issued is exposed as extended
+// attributes, so that it can be revoked.
+type credsFile struct {
+	fs   *FS
+	path string
+}
+
+var _ fs.Node = (*credsFile)(nil)
+
+func (c *credsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	c.fs.fileAttr(a, c.path, 0444)
+	return nil
+}
+
+var _ fs.NodeOpener = (*credsFile)(nil)
+
+func (c *credsFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	sec, err := c.fs.client.Logical().Read(ctx, c.path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		return nil, fuse.ENOENT
+	}
+	b, err := c.fs.marshal(sec.Data)
+	if err != nil {
+		return nil, err
+	}
+	c.fs.track(c.path, sec)
+	c.fs.mu.Lock()
+	c.fs.leases[c.path] = leaseInfo{
+		LeaseID:       sec.LeaseID,
+		LeaseDuration: sec.LeaseDuration,
+		Renewable:     sec.Renewable,
+	}
+	c.fs.mu.Unlock()
+	resp.Flags |= fuse.OpenDirectIO
+	return liveHandle(b), nil
+}
+
+// xattrs returns the lease of the last credentials issued, if any.
+func (c *credsFile) xattrs() map[string]string {
+	c.fs.mu.Lock()
+	lease, ok := c.fs.leases[c.path]
+	c.fs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return map[string]string{
+		xattrPrefix + "lease_id":       lease.LeaseID,
+		xattrPrefix + "lease_duration": strconv.Itoa(lease.LeaseDuration),
+		xattrPrefix + "renewable":      strconv.FormatBool(lease.Renewable),
+	}
+}
+
+var _ fs.NodeListxattrer = (*credsFile)(nil)
+
+func (c *credsFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(c.xattrs(), req, resp)
+}
+
+var _ fs.NodeGetxattrer = (*credsFile)(nil)
+
+func (c *credsFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(c.xattrs(), req, resp)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/crypto/scrypt"
+)
+
+// diskCache keeps copies of the secrets and listings read from Vault in
+// files under dir, so that they can be served for up to ttl after they
+// were read when Vault can't be reached.  Each file is encrypted with
+// AES-GCM, under a key derived from the passphrase if one was given and
+// otherwise from the token in use, and named by an HMAC of its path so
+// that the paths don't show either.
+//
+// Anyone able to read dir and learn the key can read the copies, for as
+// long as they're there: the files outlive the mount.  Keying by the
+// token means that whoever can decrypt them could read the secrets from
+// Vault anyway, but a new token orphans all the copies made with the
+// last; a passphrase survives token changes, but is only as strong as
+// the passphrase.
+type diskCache struct {
+	dir string
+	ttl time.Duration
+	// salt is random and kept in dir, so that keys differ between
+	// caches.
+	salt []byte
+	// passkey is the key derived from the passphrase, or nil to derive
+	// keys from the token.
+	passkey []byte
+}
+
+// openDiskCache opens the disk cache in cfg.CacheDir, creating it if need
+// be, and removes the files in it too old to be served.
+func openDiskCache(cfg Config) (*diskCache, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: cfg.CacheDir, ttl: cfg.CacheDirTTL}
+	saltfile := filepath.Join(c.dir, "salt")
+	salt, err := ioutil.ReadFile(saltfile)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(saltfile, salt, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.salt = salt
+	if cfg.CachePassphrase != "" {
+		pass, err := readValue(cfg.CachePassphrase)
+		if err != nil {
+			return nil, err
+		}
+		if c.passkey, err = scrypt.Key([]byte(pass), salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	}
+	c.prune()
+	return c, nil
+}
+
+// prune removes the files not written within the TTL, including any
+// orphaned by a change of token.
+func (c *diskCache) prune() {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Name() != "salt" && time.Since(info.ModTime()) > c.ttl {
+			_ = os.Remove(filepath.Join(c.dir, info.Name()))
+		}
+	}
+}
+
+// diskEntry is what's encrypted in a disk cache file.
+type diskEntry struct {
+	Time time.Time `json:"time"`
+	// TTL, if set, is how long the entry may be served for when that's
+	// less than the cache's TTL.
+	TTL  time.Duration   `json:"ttl,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// diskFile returns the key and the name of the disk cache file holding
+// what's cached of kind for path, and the associated data binding the
+// file's content to them.
+func (f *FS) diskFile(kind, vpath string) (key []byte, file string, ad []byte) {
+	key = f.disk.passkey
+	if key == nil {
+		key = hmacSHA256(f.disk.salt, "token\x00"+f.client.Token())
+	}
+	ad = []byte(kind + "\x00" + path.Join("/", f.nspath, vpath))
+	return key, filepath.Join(f.disk.dir, hex.EncodeToString(hmacSHA256(key, string(ad)))), ad
+}
+
+// diskPut stores v, what was read of kind from path, in the disk cache if
+// there is one, to be served for no longer than ttl if that's non-zero.
+// Failures are logged, as the cache is only a fallback.
+func (f *FS) diskPut(kind, vpath string, v interface{}, ttl time.Duration) {
+	if f.disk == nil {
+		return
+	}
+	if err := f.diskWrite(kind, vpath, v, ttl); err != nil {
+		f.cfg.Logger.Warn("can't write disk cache", "path", vpath, "error", err)
+	}
+}
+
+func (f *FS) diskWrite(kind, vpath string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(diskEntry{Time: time.Now(), TTL: ttl, Data: data})
+	if err != nil {
+		return err
+	}
+	key, file, ad := f.diskFile(kind, vpath)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.disk.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(aead.Seal(nonce, nonce, plain, ad))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// diskGet returns what's in the disk cache of kind for path, if the read
+// of it failed with err because Vault couldn't be reached, and it was
+// cached within the TTL.
+func (f *FS) diskGet(kind, vpath string, err error) ([]byte, bool) {
+	if f.disk == nil || !unreachable(err) {
+		return nil, false
+	}
+	key, file, ad := f.diskFile(kind, vpath)
+	sealed, rerr := ioutil.ReadFile(file)
+	if rerr != nil {
+		return nil, false
+	}
+	aead, aerr := newAEAD(key)
+	if aerr != nil || len(sealed) < aead.NonceSize() {
+		return nil, false
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, oerr := aead.Open(nil, nonce, sealed, ad)
+	if oerr != nil {
+		// Likely written with another token's key.
+		return nil, false
+	}
+	var e diskEntry
+	if json.Unmarshal(plain, &e) != nil {
+		return nil, false
+	}
+	age := time.Since(e.Time)
+	if age > f.disk.ttl || (e.TTL > 0 && age > e.TTL) {
+		_ = os.Remove(file)
+		return nil, false
+	}
+	f.cfg.Logger.Warn("Vault unreachable; serving from the disk cache", "path", vpath, "age", age.Round(time.Second), "error", err)
+	return e.Data, true
+}
+
+// diskDelete removes what's in the disk cache of kind for path, if
+// anything.
+func (f *FS) diskDelete(kind, vpath string) {
+	if f.disk == nil {
+		return
+	}
+	_, file, _ := f.diskFile(kind, vpath)
+	_ = os.Remove(file)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// unreachable reports whether a request failing with err got no answer,
+// or Vault was unable to give one, as opposed to refusing it.
+func unreachable(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded), err == fuse.Errno(syscall.EAGAIN):
+		return true
+	}
+	if rerr, ok := err.(*responseError); ok {
+		return rerr.StatusCode >= 500
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
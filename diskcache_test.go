@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/vault/api"
+)
+
+func TestDiskCache(t *testing.T) {
+	status := http.StatusOK
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/kvv1" && r.URL.Query().Get("list") == "true":
+			_, _ = w.Write([]byte(`{"data":{"keys":["foo"]}}`))
+		case r.URL.Path == "/v1/kvv1/foo":
+			_, _ = w.Write([]byte(`{"data":{"a":"sekrit"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	dir := t.TempDir()
+	open := func(token, passphrase string) *MountDir {
+		t.Helper()
+		f, cleanup := stubfs(t, Config{}, handler)
+		t.Cleanup(cleanup)
+		f.client.SetToken(token)
+		var err error
+		if f.disk, err = openDiskCache(Config{CacheDir: dir, CacheDirTTL: time.Hour, CachePassphrase: passphrase}); err != nil {
+			t.Fatal(err)
+		}
+		n, err := makeKvNode(f, "kvv1", &api.MountOutput{Type: "kv", Options: map[string]string{"version": "1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.(*MountDir)
+	}
+	ctx := context.Background()
+	read := func(d *MountDir) (string, error) {
+		t.Helper()
+		n, err := d.Lookup(ctx, "foo")
+		if err != nil {
+			return "", err
+		}
+		return string(n.(*File).data()), nil
+	}
+
+	d := open("tok1", "")
+	if _, err := read(d); err != nil {
+		t.Fatal(err)
+	}
+	want := []fuse.Dirent{{Name: "foo", Type: fuse.DT_File}}
+	if _, err := d.ReadDirAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("sekrit")) || bytes.Contains(b, []byte("kvv1")) {
+			t.Errorf("%s holds plaintext: %q", file, b)
+		}
+	}
+
+	status = http.StatusBadGateway
+	if got, err := read(d); err != nil || got != `{"a":"sekrit"}` {
+		t.Errorf("Vault down: got %q, %v, want the cached secret", got, err)
+	}
+	if dirs, err := d.ReadDirAll(ctx); err != nil {
+		t.Errorf("Vault down: listing got %v, want the cached listing", err)
+	} else if diff := cmp.Diff(want, dirs, ignoreInode); diff != "" {
+		t.Errorf("Vault down: listing %s", diff)
+	}
+	if _, err := read(open("tok2", "")); err == nil {
+		t.Errorf("Vault down, new token: got the secret, want an error")
+	}
+	status = http.StatusForbidden
+	if _, err := read(d); err != fuse.Errno(syscall.EACCES) {
+		t.Errorf("permission denied: got %v, want EACCES", err)
+	}
+
+	// Copies made with a passphrase survive a change of token.
+	status = http.StatusOK
+	if _, err := read(open("tok1", "hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusBadGateway
+	pd := open("tok2", "hunter2")
+	if got, err := read(pd); err != nil || got != `{"a":"sekrit"}` {
+		t.Errorf("Vault down, passphrase: got %q, %v, want the cached secret", got, err)
+	}
+	pd.fs.disk.ttl = 0
+	if _, err := read(pd); err == nil {
+		t.Errorf("Vault down, copy expired: got the secret, want an error")
+	}
+}
+
+// TestDiskCacheOutlivesReadCache checks that copies on disk are served
+// for CacheDirTTL, not for the much shorter CacheTTL of the read cache.
+func TestDiskCacheOutlivesReadCache(t *testing.T) {
+	status := http.StatusOK
+	f, cleanup := stubfs(t, Config{CacheTTL: 20 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"a":"b"}}`))
+	})
+	defer cleanup()
+	var err error
+	if f.disk, err = openDiskCache(Config{CacheDir: t.TempDir(), CacheDirTTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := f.read(ctx, "kvv1/foo"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	status = http.StatusBadGateway
+	if sec, err := f.read(ctx, "kvv1/foo"); err != nil || sec == nil || sec.Data["a"] != "b" {
+		t.Errorf("Vault down after the read cache expired: got %v, %v, want the copy on disk", sec, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// failover tracks which of several Vault servers requests should go to.
+// It's shared by the clients of all namespaces, so that they fail over
+// together.
+type failover struct {
+	mu    sync.Mutex
+	addrs []*url.URL
+	// cur is the address in use, normally one of addrs but possibly the
+	// active node some standby redirected to.
+	cur *url.URL
+}
+
+// newFailover returns a failover between addrs, or nil if there's no
+// more than one, since then there's nowhere to fail over to.  Invalid
+// addresses are caught by NewFS when it sets the first.
+func newFailover(addrs []string) *failover {
+	if len(addrs) < 2 {
+		return nil
+	}
+	f := &failover{}
+	for _, a := range addrs {
+		if u, err := url.Parse(a); err == nil {
+			f.addrs = append(f.addrs, u)
+		}
+	}
+	if len(f.addrs) == 0 {
+		return nil
+	}
+	f.cur = f.addrs[0]
+	return f
+}
+
+// target points r at the current address and returns it.  Without a
+// failover it returns r's own address.
+func (f *failover) target(r *api.Request) *url.URL {
+	if f == nil {
+		return r.URL
+	}
+	f.mu.Lock()
+	cur := f.cur
+	f.mu.Unlock()
+	r.URL.Scheme = cur.Scheme
+	r.URL.Host = cur.Host
+	return cur
+}
+
+// failed moves on from addr after a request to it failed, unless another
+// request already has.
+func (f *failover) failed(client *api.Client, addr *url.URL) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cur != addr {
+		return
+	}
+	next := f.addrs[0]
+	for i, a := range f.addrs {
+		if a == addr {
+			next = f.addrs[(i+1)%len(f.addrs)]
+		}
+	}
+	f.use(client, next)
+}
+
+// redirected switches to the server at to, to which a request sent to
+// addr was redirected.
+func (f *failover) redirected(client *api.Client, addr, to *url.URL) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cur != addr {
+		return
+	}
+	f.use(client, &url.URL{Scheme: to.Scheme, Host: to.Host})
+}
+
+// use makes addr current, and the address client uses for requests made
+// without a vaultlog.
+func (f *failover) use(client *api.Client, addr *url.URL) {
+	f.cur = addr
+	client.SetAddress(addr.String())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// SecretDir presents a secret as a directory containing a file per key,
+// used when Config.Fields is set.  With Config.Tree, keys holding objects
+// are SecretDirs too, down to the scalars.
+type SecretDir struct {
+	dir  *MountDir
+	path string
+	// keys leads from the secret's top level to data, for nested objects.
+	keys []string
+	data map[string]interface{}
+	dirNode
+}
+
+// fieldPath returns the path from which the inode number of key in d is
+// derived.
+func (d *SecretDir) fieldPath(key string) string {
+	return siblingPath(d.dir, d.path, strings.Join(append(d.keys[:len(d.keys):len(d.keys)], key), "\x00"))
+}
+
+var _ fs.Node = (*SecretDir)(nil)
+
+func (d *SecretDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	if len(d.keys) > 0 {
+		d.dir.fs.dirAttr(a, siblingPath(d.dir, d.path, strings.Join(d.keys, "\x00")), 0555)
+		return nil
+	}
+	vpath := filepath.Join(d.dir.mountpt, d.path)
+	d.dir.fs.dirAttr(a, vpath, 0555)
+	// Keep the inode the secret has as a file, leaving the directory's
+	// to any subtree of the same name.
+	a.Inode = d.dir.fs.inode(vpath, false)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SecretDir)(nil)
+
+func (d *SecretDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	keys := make([]string, 0, len(d.data))
+	for k := range d.data {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	dirs := make([]fuse.Dirent, len(keys))
+	for i, k := range keys {
+		dirs[i] = d.dir.fs.dirent(encodeName(k), fuse.DT_File, d.fieldPath(k))
+		if _, ok := d.subtree(k); ok {
+			dirs[i] = d.dir.fs.dirent(encodeName(k), fuse.DT_Dir, d.fieldPath(k))
+		}
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*SecretDir)(nil)
+
+func (d *SecretDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	v, ok := d.data[key]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if m, ok := d.subtree(key); ok {
+		return &SecretDir{
+			dir:  d.dir,
+			path: d.path,
+			keys: append(d.keys[:len(d.keys):len(d.keys)], key),
+			data: m,
+		}, nil
+	}
+	content, err := fieldContent(d.dir.fs, v)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.dir.fs, d.fieldPath(key), []byte(content)), nil
+}
+
+// subtree returns the object held by key if it's to be presented as a
+// directory.
+func (d *SecretDir) subtree(key string) (map[string]interface{}, bool) {
+	if !d.dir.fs.cfg.Tree {
+		return nil, false
+	}
+	m, ok := d.data[key].(map[string]interface{})
+	return m, ok
+}
+
+// fieldContent returns the file content for a single secret value:
+// strings are served as-is, or decoded if they're marked as base64 of
+// binary data, and anything else as JSON.
+func fieldContent(f *FS, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []byte:
+		return string(v), nil
+	case string:
+		if b, ok := decodeBinary(v); ok {
+			return string(b), nil
+		}
+		return v, nil
+	}
+	b, err := f.marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// binaryPrefix marks a string value as base64 of binary data.  Plain
+// text, such as a password or an access key ID, is often valid base64 by
+// accident, so nothing else is decoded.
+const binaryPrefix = "base64:"
+
+// decodeBinary returns the bytes encoded by s if it's marked with
+// binaryPrefix and the rest is valid base64.
+func decodeBinary(s string) ([]byte, bool) {
+	if !strings.HasPrefix(s, binaryPrefix) {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(binaryPrefix):])
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
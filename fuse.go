@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -16,71 +23,737 @@ import (
 	"github.com/hashicorp/vault/api"
 )
 
+// Config holds the settings controlling how Vault is presented.
+type Config struct {
+	// Logger receives diagnostics, including a debug record of every
+	// Vault call; nil means slog.Default().
+	Logger *slog.Logger
+
+	// Namespace is the Vault Enterprise namespace to operate within.
+	Namespace string
+
+	// Addresses, if set, are the Vault servers to use instead of
+	// VAULT_ADDR.  Requests go to the first until it fails with a network
+	// error or a 5xx status, then fail over to the next.
+	Addresses []string
+
+	// AllowOther lets users other than the one mounting access the
+	// filesystem.  Unless mounting as root, this requires
+	// user_allow_other in /etc/fuse.conf.
+	AllowOther bool
+
+	// Force lazily unmounts whatever is already mounted on the mountpoint,
+	// rather than refusing to mount.
+	Force bool
+	// MkdirMode, if non-zero, has the mountpoint and any missing parents
+	// created with these permission bits if they don't exist.
+	MkdirMode os.FileMode
+
+	// FileMode and DirMode override the permission bits of files and
+	// directories if non-zero.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// MetricsAddr, if set, is the address to serve Prometheus metrics on.
+	MetricsAddr string
+	// HealthAddr, if set, is the address to serve liveness and readiness
+	// probes on.
+	HealthAddr string
+
+	// Uid and Gid are the owner reported for all files and directories.
+	Uid uint32
+	Gid uint32
+
+	// Retries is how many times to retry a Vault request failing with a
+	// 5xx status or a network error.
+	Retries int
+	// RequestTimeout, if non-zero, bounds how long a filesystem operation
+	// waits on each Vault call, including retries.
+	RequestTimeout time.Duration
+
+	// ReadOnly rejects all modifications with EROFS.
+	ReadOnly bool
+	// DryRun logs the writes and deletes that modifications would make
+	// of Vault, at info level, and has them succeed without making them.
+	DryRun bool
+	// Patch merges what's written to KV v2 secrets into their current
+	// data, so that keys left out are kept rather than deleted.
+	Patch bool
+	// MaxConcurrency, if positive, limits how many Vault requests can be
+	// in progress at once.  Further requests wait their turn.
+	MaxConcurrency int
+	// ReservedPrefix is prepended to the names of the unlisted files,
+	// such as the flush control file, that are looked up ahead of mounts
+	// and secrets.  Defaults to defaultReservedPrefix.
+	ReservedPrefix string
+	// WriteThrough writes a file's content to Vault after each write to
+	// it that leaves valid content, rather than when it's flushed.
+	WriteThrough bool
+
+	// Fields presents each secret as a directory containing a file per
+	// key, instead of as a single file of JSON.  Values of the form
+	// "base64:<data>" are served decoded.
+	Fields bool
+
+	// Raw serves secrets with a single string value as just that value,
+	// without JSON.
+	Raw bool
+
+	// Tree, which implies Fields, presents the objects nested in secrets
+	// as directories too, so that only scalars and arrays are files.
+	Tree bool
+
+	// Indent pretty-prints JSON secret contents.
+	Indent bool
+
+	// Mount, if set, names the one mount to expose, presented as the root
+	// rather than as a directory of it.  The root's control files are
+	// then unavailable.
+	Mount string
+	// MountNamespaces maps the names of mounts to the namespaces, relative
+	// to Namespace, in which to find them.  They're shown among the mounts
+	// of Namespace, in place of any of the same name there, and operated
+	// on with a client of their own.
+	MountNamespaces map[string]string
+	// MountAllow, if non-empty, lists the only mounts to expose.
+	MountAllow []string
+	// MountDeny lists mounts not to expose, even if in MountAllow.
+	MountDeny []string
+	// BrowseUnsupported exposes mounts of engines without a maker of
+	// their own, browsing them like KV v1.  Otherwise they're hidden.
+	BrowseUnsupported bool
+
+	// CaseInsensitive has lookups of mounts and keys that aren't found
+	// find those differing from them only by case, as tools on
+	// case-insensitive filesystems like macOS's expect.
+	CaseInsensitive bool
+
+	// MetaSuffix, if set, names a sibling file alongside each KV v2
+	// secret containing its metadata.
+	MetaSuffix string
+
+	// CustomMetaSuffix, if set, names a sibling file alongside each KV
+	// v2 secret containing its custom metadata, which writing replaces.
+	CustomMetaSuffix string
+
+	// VersionsSuffix, if set, names a sibling directory alongside each KV
+	// v2 secret containing a file per version.
+	VersionsSuffix string
+
+	// LeaseSuffix, if set, names a sibling file alongside each secret of
+	// an engine without a maker of its own, containing the lease of the
+	// response the secret was read from.
+	LeaseSuffix string
+
+	// WrapSuffix, if set, names a sibling file alongside each secret
+	// which, each time it's opened, holds a new response-wrapping token
+	// for the secret that's valid for WrapTTL.
+	WrapSuffix string
+	WrapTTL    time.Duration
+
+	// WarningsSuffix, if set, names a sibling file alongside each secret
+	// containing the request ID and warnings of the response the secret
+	// was read from.
+	WarningsSuffix string
+
+	// TokenFile, if set, names a file holding the token to use instead of
+	// VAULT_TOKEN.  It's watched so that a new token written there is used.
+	TokenFile string
+
+	// Auth is the auth method used to obtain a token; empty means use the
+	// token from the environment.
+	Auth string
+	// RoleID and SecretID are the AppRole credentials.  A value starting
+	// with "@" names a file to read it from.
+	RoleID   string
+	SecretID string
+	// AWSRole is the Vault role to log in as with the aws auth method.
+	AWSRole string
+
+	// ClientCert and ClientKey name the PEM files of the TLS client
+	// certificate to present, as needed by the cert auth method.  CACert
+	// names a PEM bundle of the CAs to verify Vault's certificate with.
+	// They're applied on top of VAULT_CLIENT_CERT and the like.
+	ClientCert string
+	ClientKey  string
+	CACert     string
+	// TLSSkipVerify disables verification of Vault's certificate, as
+	// VAULT_SKIP_VERIFY does.  It's only for testing: anyone able to
+	// intercept traffic to Vault can then read and forge secrets.
+	TLSSkipVerify bool
+
+	// RenewInterval is how often to renew the token; zero means at half
+	// its TTL.
+	RenewInterval time.Duration
+	// UnmountOnExpiry unmounts the filesystem once the token can no
+	// longer be renewed.
+	UnmountOnExpiry bool
+
+	// ListCacheTTL is how long directory listings used by lookups,
+	// including those made by readdir, are cached; zero disables caching.
+	ListCacheTTL time.Duration
+
+	// CacheTTL is how long secret contents are cached; zero disables
+	// caching.
+	CacheTTL time.Duration
+
+	// CacheDir, if set, is a directory in which encrypted copies of the
+	// secrets and listings read are kept, to be served for up to
+	// CacheDirTTL after they were read if Vault can't be reached.  See
+	// diskCache for what that exposes.
+	CacheDir    string
+	CacheDirTTL time.Duration
+	// CachePassphrase, if set, is what the disk cache's key is derived
+	// from instead of the token.  A value starting with "@" names a file
+	// to read it from.
+	CachePassphrase string
+
+	// NegativeCacheTTL is how long lookups of missing names keep failing
+	// with ENOENT without asking Vault again; zero disables caching.
+	NegativeCacheTTL time.Duration
+
+	// ReadDirConcurrency is how many secrets are read at once when
+	// prefetching a directory's secrets into the cache; zero disables
+	// prefetching.
+	ReadDirConcurrency int
+
+	// EntryCounts reports the size of a directory in a mount as the number
+	// of entries Vault returned when it was last listed, if it has been,
+	// giving a cheap idea of how many secrets it holds.
+	EntryCounts bool
+
+	// PollInterval, if non-zero, is how often secrets held open or cached
+	// by the kernel are re-read, so that changes made by other Vault
+	// clients are seen.
+	PollInterval time.Duration
+
+	// SubtreeSuffix is appended to the name of a subtree sharing its name
+	// with a secret, e.g. when both "foo" and "foo/bar" exist.  If empty,
+	// such subtrees are hidden.
+	SubtreeSuffix string
+}
+
 type FS struct {
 	client *vaultapi
+	cfg    Config
+
+	// dirs records directories created by mkdir, keyed by their path
+	// including the mountpoint.  Vault doesn't persist empty paths, so
+	// without this they'd vanish on the next lookup.
+	mu   sync.Mutex
+	dirs map[string]bool
+
+	// lists caches List results by Vault path.
+	lists *ttlCache
+	// secrets caches Read results by Vault path.
+	secrets *ttlCache
+	// missing caches failed lookups by path under the root.
+	missing *ttlCache
+	// disk, if not nil, keeps secrets and listings for when Vault can't
+	// be reached.  It's shared with child namespaces.
+	disk *diskCache
+
+	// namespaces holds the FS for each child namespace visited.
+	namespaces map[string]*FS
+
+	// opFiles holds the opFiles created, keyed by Vault path.
+	opFiles map[string]*opFile
+
+	// watched holds the secret files known to the kernel, which are
+	// polled for changes if PollInterval is set.
+	watched map[*File]bool
+
+	// leases holds the lease of the credentials last issued for each
+	// dynamic secret path, guarded by mu.
+	leases map[string]leaseInfo
+
+	// issued holds every lease handed out, for the leases directory.
+	issued *leaseTracker
+
+	// counts holds the number of entries in each Vault path as of its
+	// last listing, if EntryCounts is set, guarded by mu.
+	counts map[string]int
+
+	// kvv2 records for each KV mount, keyed by mountpoint, whether it's
+	// version 2, once detected.  Guarded by mu.
+	kvv2 map[string]bool
+
+	// nspath is the path of f's namespace relative to the one mounted,
+	// which is empty unless f is a child namespace.
+	nspath string
 }
 
-func NewFS() (*FS, error) {
-	client, err := api.NewClient(nil)
+func NewFS(cfg Config) (*FS, error) {
+	vcfg, err := apiConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := api.NewClient(vcfg)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Namespace != "" {
+		client.SetNamespace(cfg.Namespace)
+	}
+	if len(cfg.Addresses) > 0 {
+		if err := client.SetAddress(cfg.Addresses[0]); err != nil {
+			return nil, err
+		}
+	}
+	// Retries are done by vaultlog, so that they can be logged and counted.
+	client.SetMaxRetries(0)
+	if cfg.TokenFile != "" {
+		token, err := readValue("@" + cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		client.SetToken(token)
+	}
+	if err := login(client, cfg); err != nil {
+		return nil, err
+	}
+
+	f := newFS(&vaultapi{Client: client, logger: cfg.Logger}, cfg)
+	if cfg.CacheDir != "" {
+		if f.disk, err = openDiskCache(f.cfg); err != nil {
+			return nil, fmt.Errorf("-cache-dir: %v", err)
+		}
+	}
+	if cfg.WriteThrough {
+		f.cfg.Logger.Warn("write-through is enabled; every write to a file is a Vault request")
+	}
+	return f, nil
+}
+
+// apiConfig returns the Vault client configuration from the environment,
+// with the TLS settings in cfg applied so that they're in force from the
+// first request.
+func apiConfig(cfg Config) (*api.Config, error) {
+	vcfg := api.DefaultConfig()
+	if vcfg.Error != nil {
+		return nil, vcfg.Error
+	}
+	envInsecure, _ := strconv.ParseBool(os.Getenv(api.EnvVaultSkipVerify))
+	if cfg.TLSSkipVerify || envInsecure {
+		logger := cfg.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("TLS certificate verification is disabled; secrets can be intercepted, do not use this in production")
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" || cfg.CACert != "" || cfg.TLSSkipVerify {
+		err := vcfg.ConfigureTLS(&api.TLSConfig{
+			ClientCert: cfg.ClientCert,
+			ClientKey:  cfg.ClientKey,
+			CACert:     cfg.CACert,
+			Insecure:   cfg.TLSSkipVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("configuring TLS: %v", err)
+		}
+	}
+	return vcfg, nil
+}
 
+func newFS(client *vaultapi, cfg Config) *FS {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Tree {
+		cfg.Fields = true
+	}
+	if cfg.ReservedPrefix == "" {
+		cfg.ReservedPrefix = defaultReservedPrefix
+	}
+	if client.logger == nil {
+		client.logger = cfg.Logger
+	}
+	client.retries = cfg.Retries
+	client.timeout = cfg.RequestTimeout
+	client.dryRun = cfg.DryRun
+	if client.failover == nil {
+		client.failover = newFailover(cfg.Addresses)
+	}
+	if client.seal == nil {
+		client.seal = &sealWatch{}
+	}
+	if client.inflight == nil && cfg.MaxConcurrency > 0 {
+		client.inflight = make(chan struct{}, cfg.MaxConcurrency)
+	}
 	return &FS{
-		client: &vaultapi{client},
-	}, nil
+		client:  client,
+		cfg:     cfg,
+		dirs:    make(map[string]bool),
+		lists:   newTTLCache(cfg.ListCacheTTL),
+		secrets: newTTLCache(cfg.CacheTTL),
+		missing: newTTLCache(cfg.NegativeCacheTTL),
+
+		namespaces: make(map[string]*FS),
+		opFiles:    make(map[string]*opFile),
+		watched:    make(map[*File]bool),
+		leases:     make(map[string]leaseInfo),
+		issued:     newLeaseTracker(),
+		counts:     make(map[string]int),
+		kvv2:       make(map[string]bool),
+	}
+}
+
+// inode returns the inode number of the node at p, a Vault path in f's
+// namespace.  It's a hash of the path, so it's stable across lookups and
+// remounts, and is distinct for a directory and a file of the same name
+// like a secret and its subtree.  The root directory is inode 1.
+func (f *FS) inode(p string, dir bool) uint64 {
+	p = path.Join("/", f.nspath, p)
+	if dir {
+		if p == "/" {
+			return 1
+		}
+		p += "/"
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(p))
+	// Zero isn't a valid inode number and 1 is taken by the root.
+	ino := h.Sum64()
+	if ino <= 1 {
+		ino += 2
+	}
+	return ino
+}
+
+// fileAttr sets the inode, mode and ownership of the file at path whose
+// default permission bits are def.
+func (f *FS) fileAttr(a *fuse.Attr, path string, def os.FileMode) {
+	a.Inode = f.inode(path, false)
+	a.Mode = def
+	if f.cfg.FileMode != 0 {
+		a.Mode = f.cfg.FileMode
+	}
+	a.Uid = f.cfg.Uid
+	a.Gid = f.cfg.Gid
+}
+
+// dirSize is the size reported for directories, that of a directory
+// occupying a single block on most local filesystems.
+const dirSize = 4096
+
+// dirAttr sets the inode, mode, ownership and size of the directory at
+// path whose default permission bits are def.  The link count is that of
+// a directory without subdirectories; callers knowing of some without
+// further requests to Vault add them.
+func (f *FS) dirAttr(a *fuse.Attr, path string, def os.FileMode) {
+	a.Inode = f.inode(path, true)
+	a.Nlink = 2
+	a.Size = dirSize
+	if f.cfg.DirMode != 0 {
+		def = f.cfg.DirMode
+	}
+	a.Mode = os.ModeDir | def
+	a.Uid = f.cfg.Uid
+	a.Gid = f.cfg.Gid
+}
+
+// dirNode is embedded in directories so that reading one fails with
+// EISDIR, rather than the ENOTSUP bazil gives handles without Read.
+type dirNode struct{}
+
+var _ fs.HandleReader = dirNode{}
+
+func (dirNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	return fuse.Errno(syscall.EISDIR)
+}
+
+// checkNotDir fails the opendir of a file with ENOTDIR, which bazil would
+// otherwise have list as empty.
+func checkNotDir(req *fuse.OpenRequest) error {
+	if req.Dir {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// dirent returns the directory entry name of type dtype for the node at
+// path, with the inode number that fileAttr or dirAttr gives it.
+func (f *FS) dirent(name string, dtype fuse.DirentType, path string) fuse.Dirent {
+	return fuse.Dirent{
+		Inode: f.inode(path, dtype == fuse.DT_Dir),
+		Name:  name,
+		Type:  dtype,
+	}
+}
+
+// checkWritable returns EROFS if the filesystem is mounted read-only.  All
+// operations that modify Vault go through here first.
+func (f *FS) checkWritable() error {
+	if f.cfg.ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+// marshal encodes v as JSON for serving as file content.
+func (f *FS) marshal(v interface{}) ([]byte, error) {
+	if f.cfg.Indent {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+func (f *FS) addDir(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirs[path] = true
+}
+
+// removeDir forgets a directory created by mkdir, returning false if
+// there was none.
+func (f *FS) removeDir(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirs[path] {
+		return false
+	}
+	delete(f.dirs, path)
+	return true
+}
+
+func (f *FS) hasDir(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dirs[path]
+}
+
+// subdirs returns the names of directories created by mkdir directly
+// under parent.
+func (f *FS) subdirs(parent string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for path := range f.dirs {
+		if filepath.Dir(path) == parent {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	return names
 }
 
 var _ fs.FS = (*FS)(nil)
 
 func (f *FS) Root() (fs.Node, error) {
-	mounts, err := f.client.Sys().ListMounts()
+	mounts, err := f.listMounts(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	return &RootDir{
-		fs:     f,
-		mounts: mounts,
-	}, nil
+	if f.cfg.Mount != "" {
+		name := strings.Trim(f.cfg.Mount, "/")
+		mount := mounts[name+"/"]
+		if mount == nil {
+			return nil, fmt.Errorf("mount %q not found", name)
+		}
+		mf, err := f.mountFS(name)
+		if err != nil {
+			return nil, err
+		}
+		return makeMountNode(mf, name, mount)
+	}
+	d := &RootDir{fs: f}
+	d.mounts.Store(mounts)
+	return d, nil
+}
+
+// listMounts returns the mounts to expose, keyed by path with a trailing
+// slash as Vault returns them.
+func (f *FS) listMounts(ctx context.Context) (map[string]*api.MountOutput, error) {
+	mounts, err := f.client.Logical().ListMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nsmounts := make(map[string]map[string]*api.MountOutput)
+	for name, ns := range f.cfg.MountNamespaces {
+		delete(mounts, name+"/")
+		if nsmounts[ns] == nil {
+			child, err := f.namespaceFS(ns)
+			if err != nil {
+				return nil, err
+			}
+			if nsmounts[ns], err = child.client.Logical().ListMounts(ctx); err != nil {
+				return nil, fmt.Errorf("namespace %s: %v", ns, err)
+			}
+		}
+		if mount := nsmounts[ns][name+"/"]; mount != nil {
+			mounts[name+"/"] = mount
+		} else {
+			f.cfg.Logger.Debug("no such mount in namespace", "mount", name, "namespace", ns)
+		}
+	}
+	for mntpt, mount := range mounts {
+		if !f.mountAllowed(strings.TrimSuffix(mntpt, "/")) {
+			delete(mounts, mntpt)
+		} else if nodeMakers[mount.Type] == nil && !f.cfg.BrowseUnsupported {
+			f.cfg.Logger.Debug("hiding mount of unsupported type", "mount", mntpt, "type", mount.Type)
+			delete(mounts, mntpt)
+		}
+	}
+	return mounts, nil
+}
+
+// mountFS returns the FS for operating on the mount named name: f, unless
+// MountNamespaces puts the mount in another namespace.
+func (f *FS) mountFS(name string) (*FS, error) {
+	if ns, ok := f.cfg.MountNamespaces[name]; ok {
+		return f.namespaceFS(ns)
+	}
+	return f, nil
+}
+
+// mountAllowed reports whether the mount named name passes the
+// MountAllow and MountDeny filters.
+func (f *FS) mountAllowed(name string) bool {
+	for _, deny := range f.cfg.MountDeny {
+		if name == deny {
+			return false
+		}
+	}
+	if len(f.cfg.MountAllow) == 0 {
+		return true
+	}
+	for _, allow := range f.cfg.MountAllow {
+		if name == allow {
+			return true
+		}
+	}
+	return false
+}
+
+var _ fs.FSStatfser = (*FS)(nil)
+
+// Statfs reports synthetic values, since Vault has no meaningful capacity
+// but some file managers refuse to display a filesystem reporting zeros.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	const (
+		blockSize = 4096
+		blocks    = 1 << 30 // 4TiB worth
+		files     = 1 << 20
+	)
+	resp.Blocks = blocks
+	resp.Bfree = blocks
+	resp.Bavail = blocks
+	resp.Bsize = blockSize
+	resp.Frsize = blockSize
+	resp.Namelen = 255
+
+	resp.Files = files
+	if mounts, err := f.client.Logical().ListMounts(ctx); err == nil {
+		resp.Files += uint64(len(mounts))
+	}
+	resp.Ffree = files
+	return nil
 }
 
 // RootDir implements both Node and Handle for the root directory.
 type RootDir struct {
 	fs *FS
-	// mounts maps mountpoint (including trailing slash) to mount entry
-	mounts map[string]*api.MountOutput
+	// mounts holds a map of mountpoint (including trailing slash) to mount
+	// entry.  The map is replaced wholesale on refresh, never modified,
+	// so lookups can proceed while the mounts are being refreshed.
+	mounts atomic.Value
+	dirNode
+}
+
+// refresh re-fetches the mounts so that newly enabled engines appear.
+func (d *RootDir) refresh(ctx context.Context) (map[string]*api.MountOutput, error) {
+	mounts, err := d.fs.listMounts(ctx)
+	if err != nil {
+		return nil, errno(err)
+	}
+	d.mounts.Store(mounts)
+	return mounts, nil
+}
+
+// currentMounts returns the mounts as of the last refresh.
+func (d *RootDir) currentMounts() map[string]*api.MountOutput {
+	mounts, _ := d.mounts.Load().(map[string]*api.MountOutput)
+	return mounts
+}
+
+func (d *RootDir) mount(name string) *api.MountOutput {
+	return d.currentMounts()[name+"/"]
+}
+
+// mountNames returns the paths of mounts, in no particular order.
+func mountNames(mounts map[string]*api.MountOutput) []string {
+	names := make([]string, 0, len(mounts))
+	for name := range mounts {
+		names = append(names, name)
+	}
+	return names
 }
 
 var _ fs.Node = (*RootDir)(nil)
 
 func (d *RootDir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0555
+	d.fs.dirAttr(a, "", 0555)
+	// Namespaces aren't counted, since listing them takes a request.
+	a.Nlink += uint32(len(d.currentMounts()))
 	return nil
 }
 
 var _ fs.NodeStringLookuper = (*RootDir)(nil)
 
-type nodeMaker func(*FS, string, *api.MountOutput) (*MountDir, error)
+type nodeMaker func(*FS, string, *api.MountOutput) (fs.Node, error)
 
 var nodeMakers = map[string]nodeMaker{
-	"kv": makeKvNode,
+	"aws":       makeAwsNode,
+	"cubbyhole": makeCubbyholeNode,
+	"database":  makeDatabaseNode,
+	"identity":  makeIdentityNode,
+	"kv":        makeKvNode,
+	"pki":       makePkiNode,
+	"ssh":       makeSshNode,
+	"system":    makeSysNode,
+	"totp":      makeTotpNode,
+	"transit":   makeTransitNode,
 }
 
 func (d *RootDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	mount := d.mounts[name+"/"]
+	if base, ok := d.fs.reserved(name); ok {
+		if control := controlFiles[base]; control != nil {
+			return control(d), nil
+		}
+	}
+	name = d.fs.foldName(name, mountNames(d.currentMounts()))
+	mount := d.mount(name)
+	if mount == nil {
+		// Perhaps enabled since we last looked.
+		mounts, err := d.refresh(ctx)
+		if err != nil {
+			return nil, err
+		}
+		name = d.fs.foldName(name, mountNames(mounts))
+		mount = mounts[name+"/"]
+	}
 	if mount == nil {
-		return nil, fmt.Errorf("no such mount: %q", name)
+		return d.lookupNamespace(ctx, name)
 	}
+	mf, err := d.fs.mountFS(name)
+	if err != nil {
+		return nil, err
+	}
+	return makeMountNode(mf, name, mount)
+}
+
+// makeMountNode returns the node presenting the mount at mountpt, made by
+// the maker for its type.
+func makeMountNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
 	maker := nodeMakers[mount.Type]
 	if maker == nil {
-		return newFile(""), nil
+		maker = makeGenericNode
 	}
-	return maker(d.fs, name, mount)
+	return maker(f, mountpt, mount)
 }
 
-func makeKvNode(f *FS, mountpt string, mount *api.MountOutput) (*MountDir, error) {
+func makeKvNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
 	var adj pathAdjustor = basePathAdjustor{}
-	if mount.Options["version"] == "2" {
+	if f.isKVv2(context.Background(), mountpt, mount) {
 		adj = kvv2PathAdjustor{}
 	}
 	return &MountDir{
@@ -91,22 +764,81 @@ func makeKvNode(f *FS, mountpt string, mount *api.MountOutput) (*MountDir, error
 	}, nil
 }
 
+// makeCubbyholeNode presents a cubbyhole mount like KV v1.  Cubbyholes are
+// scoped to a token, so what's shown is the cubbyhole of the token used to
+// mount the filesystem.
+func makeCubbyholeNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &MountDir{
+		fs:           f,
+		mountpt:      mountpt,
+		mount:        mount,
+		pathAdjustor: basePathAdjustor{},
+	}, nil
+}
+
+// makeGenericNode presents a mount of a type without a maker of its own
+// like KV v1, if BrowseUnsupported is set.
+func makeGenericNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &MountDir{
+		fs:           f,
+		mountpt:      mountpt,
+		mount:        mount,
+		pathAdjustor: basePathAdjustor{},
+		generic:      true,
+	}, nil
+}
+
 var _ fs.HandleReadDirAller = (*RootDir)(nil)
 
 func (d *RootDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	dirs := make([]fuse.Dirent, 0, len(d.mounts))
-	for mntpt := range d.mounts {
-		dirs = append(dirs, fuse.Dirent{
-			Name: strings.TrimSuffix(mntpt, "/"),
-			Type: fuse.DT_Dir,
-		})
+	mounts, err := d.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := d.fs.listNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]fuse.Dirent, 0, len(mounts)+len(namespaces))
+	for mntpt := range mounts {
+		name := strings.TrimSuffix(mntpt, "/")
+		mf, err := d.fs.mountFS(name)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, mf.dirent(name, fuse.DT_Dir, name))
+	}
+	for _, ns := range namespaces {
+		// Mounts take precedence over namespaces of the same name.
+		if mounts[ns+"/"] == nil {
+			dirs = append(dirs, d.fs.dirent(ns, fuse.DT_Dir, ns))
+		}
 	}
 	return dirs, nil
 }
 
+// lookupNamespace returns the root of the child namespace name.
+func (d *RootDir) lookupNamespace(ctx context.Context, name string) (fs.Node, error) {
+	namespaces, err := d.fs.listNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range namespaces {
+		if ns == name {
+			child, err := d.fs.namespaceFS(name)
+			if err != nil {
+				return nil, err
+			}
+			return child.Root()
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
 type pathAdjustor interface {
 	pathlist(in string) string
 	pathread(in string) string
+	pathdelete(in string) string
 }
 
 type basePathAdjustor struct{}
@@ -117,6 +849,9 @@ func (a basePathAdjustor) pathlist(in string) string {
 func (a basePathAdjustor) pathread(in string) string {
 	return in
 }
+func (a basePathAdjustor) pathdelete(in string) string {
+	return in
+}
 
 var _ pathAdjustor = basePathAdjustor{}
 
@@ -129,65 +864,398 @@ func (a kvv2PathAdjustor) pathread(in string) string {
 	return filepath.Join("data", in)
 }
 
+// pathversion returns the path and query data to read the given version.
+func (a kvv2PathAdjustor) pathversion(in string, version string) (string, map[string][]string) {
+	return a.pathread(in), map[string][]string{
+		"version": {version},
+	}
+}
+
+// pathdelete uses the metadata path: deleting via data/ only soft-deletes
+// the latest version, whereas we want rm to remove the secret entirely.
+func (a kvv2PathAdjustor) pathdelete(in string) string {
+	return filepath.Join("metadata", in)
+}
+
 var _ pathAdjustor = kvv2PathAdjustor{}
 
 func list(ctx context.Context, client *vaultapi, path string) ([]string, error) {
-	sec, err := client.Logical().List(path)
-	if sec == nil || err != nil {
-		return nil, err
+	sec, err := client.Logical().List(ctx, path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		return nil, nil
 	}
 	listRaw := sec.Data["keys"]
 	if listRaw == nil {
 		return nil, nil
 	}
-	list := listRaw.([]interface{})
+	// Don't trust the shape of the response: a panic here would take the
+	// whole filesystem down.
+	list, ok := listRaw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("listing %s: keys are a %T, not a list", path, listRaw)
+	}
 	ss := make([]string, len(list))
 	for i, l := range list {
-		ss[i] = l.(string)
+		s, ok := l.(string)
+		if !ok {
+			return nil, fmt.Errorf("listing %s: key %v is a %T, not a string", path, l, l)
+		}
+		ss[i] = s
 	}
 	return ss, nil
 }
 
-func listDirents(ctx context.Context, client *vaultapi, path string) ([]fuse.Dirent, error) {
-	ss, err := list(ctx, client, path)
+// cachedList is like list but reuses recent results for the same path.
+func (f *FS) cachedList(ctx context.Context, path string) ([]string, error) {
+	if ss, ok := f.lists.get(path); ok {
+		return ss.([]string), nil
+	}
+	ss, err := list(ctx, f.client, path)
 	if err != nil {
+		if b, ok := f.diskGet("list", path, err); ok && json.Unmarshal(b, &ss) == nil {
+			return ss, nil
+		}
 		return nil, err
 	}
-	dirs := make([]fuse.Dirent, len(ss))
-	for i, s := range ss {
-		if strings.HasSuffix(s, "/") {
-			dirs[i] = fuse.Dirent{
-				Name: s,
-				Type: fuse.DT_Dir,
-			}
-		} else {
-			dirs[i] = fuse.Dirent{
-				Name: s,
-				Type: fuse.DT_File,
+	f.lists.set(path, ss)
+	f.setCount(path, len(ss))
+	f.diskPut("list", path, ss, 0)
+	return ss, nil
+}
+
+// setCount records the number of entries Vault listed at path.
+func (f *FS) setCount(path string, n int) {
+	if !f.cfg.EntryCounts {
+		return
+	}
+	f.mu.Lock()
+	f.counts[path] = n
+	f.mu.Unlock()
+}
+
+// count returns the number of entries Vault listed at path last time, if
+// it's been listed.
+func (f *FS) count(path string) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.counts[path]
+	return n, ok
+}
+
+// read is like Logical().Read but reuses recent results for the same path.
+func (f *FS) read(ctx context.Context, path string) (*api.Secret, error) {
+	if sec, ok := f.secrets.get(path); ok {
+		return sec.(*api.Secret), nil
+	}
+	sec, err := f.client.Logical().Read(ctx, path)
+	if err != nil {
+		if b, ok := f.diskGet("read", path, err); ok {
+			if sec, perr := api.ParseSecret(bytes.NewReader(b)); perr == nil {
+				return sec, nil
 			}
 		}
+		return nil, err
 	}
-	return dirs, nil
+	if sec == nil {
+		f.diskDelete("read", path)
+		return nil, nil
+	}
+	f.track(path, sec)
+	// Leased secrets, such as dynamic credentials, mustn't be served past
+	// their lease, from memory or disk.
+	lease := time.Duration(sec.LeaseDuration) * time.Second
+	ttl := f.cfg.CacheTTL
+	if lease > 0 {
+		ttl = lease
+	}
+	f.secrets.setTTL(path, sec, ttl)
+	f.diskPut("read", path, sec, lease)
+	return sec, nil
 }
 
-type MountDir struct {
-	fs      *FS
-	mountpt string
-	mount   *api.MountOutput
-	pathAdjustor
+// invalidate drops cached state affected by a change to the secret at
+// relpath.
+func (d *MountDir) invalidate(relpath string) {
+	d.fs.secrets.delete(filepath.Join(d.mountpt, d.pathread(relpath)))
+	d.fs.diskDelete("read", filepath.Join(d.mountpt, d.pathread(relpath)))
+	d.fs.missing.delete(filepath.Join(d.mountpt, relpath))
+	d.invalidateLists(relpath)
 }
 
-var _ fs.Node = (*MountDir)(nil)
-
-func (d *MountDir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0555
-	return nil
+// invalidateLists drops the cached listings that a change to the secret
+// at relpath may affect, i.e. those of all its ancestors within d.
+func (d *MountDir) invalidateLists(relpath string) {
+	for {
+		relpath = filepath.Dir(relpath)
+		d.fs.lists.delete(filepath.Join(d.mountpt, d.pathlist(relpath)))
+		if relpath == "." || relpath == "/" {
+			return
+		}
+	}
+}
+
+// listDirents returns the directory entries for the list of path.  base
+// is the path under which the nodes of the entries report their inodes.
+func listDirents(ctx context.Context, f *FS, path, base string) ([]fuse.Dirent, error) {
+	ss, err := list(ctx, f.client, path)
+	if err != nil {
+		return nil, err
+	}
+	return f.dirents(base, ss), nil
+}
+
+// dirents returns the directory entries for ss, the result of a list, with
+// the inodes of the nodes at those keys under base.
+func (f *FS) dirents(base string, ss []string) []fuse.Dirent {
+	dirs := make([]fuse.Dirent, 0, len(ss))
+	for _, s := range ss {
+		name, dtype := s, fuse.DT_File
+		if strings.HasSuffix(s, "/") {
+			name, dtype = strings.TrimSuffix(s, "/"), fuse.DT_Dir
+		}
+		switch name {
+		case "", ".", "..":
+			// Can't be presented, nor read since Vault paths are cleaned.
+			continue
+		}
+		dirs = append(dirs, f.dirent(encodeName(name), dtype, filepath.Join(base, name)))
+	}
+	return dirs
+}
+
+// renameSubtrees applies SubtreeSuffix to the directories in dirs sharing
+// their name with a secret.
+func (f *FS) renameSubtrees(dirs []fuse.Dirent) []fuse.Dirent {
+	secrets := make(map[string]bool)
+	for _, dirent := range dirs {
+		if dirent.Type == fuse.DT_File {
+			secrets[dirent.Name] = true
+		}
+	}
+	ret := dirs[:0]
+	for _, dirent := range dirs {
+		if dirent.Type == fuse.DT_Dir && secrets[dirent.Name] {
+			if f.cfg.SubtreeSuffix == "" {
+				continue
+			}
+			dirent.Name += f.cfg.SubtreeSuffix
+		}
+		ret = append(ret, dirent)
+	}
+	return ret
+}
+
+// subtreeName returns the name in ss, a listing, of the subtree presented
+// as name because a secret shares its name, or "" if there's none.
+func (f *FS) subtreeName(ss []string, name string) string {
+	sfx := f.cfg.SubtreeSuffix
+	if sfx == "" || !strings.HasSuffix(name, sfx) {
+		return ""
+	}
+	base := strings.TrimSuffix(name, sfx)
+	var secret, subtree bool
+	for _, s := range ss {
+		switch s {
+		case base:
+			secret = true
+		case base + "/":
+			subtree = true
+		}
+	}
+	if secret && subtree {
+		return base
+	}
+	return ""
+}
+
+type MountDir struct {
+	fs      *FS
+	mountpt string
+	mount   *api.MountOutput
+	pathAdjustor
+	dirNode
+
+	// generic is set for mounts of engine types we know nothing about,
+	// where an empty listing more likely means LIST isn't supported than
+	// that there's nothing there.
+	generic bool
+}
+
+var _ fs.Node = (*MountDir)(nil)
+
+func (d *MountDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	mountAttr(d, "", a)
+	return nil
+}
+
+// mountAttr sets the attributes of the directory at relpath in the mount
+// d.  Subdirectories are counted in the link count if its listing is
+// cached.
+func mountAttr(d *MountDir, relpath string, a *fuse.Attr) {
+	path := filepath.Join(d.mountpt, relpath)
+	if d.fs.cfg.ReadOnly {
+		d.fs.dirAttr(a, path, 0555)
+	} else {
+		d.fs.dirAttr(a, path, 0755)
+	}
+	listpath := filepath.Join(d.mountpt, d.pathlist(relpath))
+	if n, ok := d.fs.count(listpath); ok {
+		a.Size = uint64(n)
+	}
+	ss, ok := d.fs.lists.get(listpath)
+	if !ok {
+		return
+	}
+	// Each secret is a directory too with Fields set, and has any
+	// directory siblings.
+	perSecret := 0
+	if d.fs.cfg.Fields {
+		perSecret++
+	}
+	for _, sib := range d.siblings() {
+		if sib.dtype == fuse.DT_Dir {
+			perSecret++
+		}
+	}
+	for _, s := range ss.([]string) {
+		if strings.HasSuffix(s, "/") {
+			a.Nlink++
+		} else {
+			a.Nlink += uint32(perSecret)
+		}
+	}
+}
+
+// mountInfo returns the file describing d's mount: its type, description,
+// options and config, as listed by sys/mounts.
+func (d *MountDir) mountInfo() (fs.Node, error) {
+	b, err := d.fs.marshal(d.mount)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, siblingPath(d, "", "mount"), b), nil
+}
+
+// isKVv2 reports whether d is a version 2 KV mount, whose secrets are
+// wrapped in a "data" envelope.
+func (d *MountDir) isKVv2() bool {
+	_, ok := d.pathAdjustor.(kvv2PathAdjustor)
+	return d.mount.Type == "kv" && ok
 }
 
 var _ fs.NodeStringLookuper = (*MountDir)(nil)
 
 func (d *MountDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return listDirents(ctx, d.fs.client, filepath.Join(d.mountpt, d.pathlist("")))
+	return readDir(ctx, d, "")
+}
+
+// readDir lists relpath, including any directories created by mkdir that
+// don't yet exist in Vault.
+//
+// The whole listing is built at once: this version of bazil has no
+// offset-based readdir for a directory to page through its entries
+// itself.  It encodes what ReadDirAll returns when a handle first reads,
+// and serves the kernel's reads at later offsets from that, so each open
+// handle does see a stable snapshot.  Nor could paging save a request,
+// as Vault returns a LIST in one response.
+func readDir(ctx context.Context, d *MountDir, relpath string) ([]fuse.Dirent, error) {
+	// Always list afresh, but cache the result for the lookups of each
+	// entry that typically follow, as in a recursive walk.
+	listpath := filepath.Join(d.mountpt, d.pathlist(relpath))
+	ss, err := list(ctx, d.fs.client, listpath)
+	if err != nil {
+		if b, ok := d.fs.diskGet("list", listpath, err); !ok || json.Unmarshal(b, &ss) != nil {
+			return nil, err
+		}
+	} else {
+		d.fs.lists.set(listpath, ss)
+		d.fs.diskPut("list", listpath, ss, 0)
+	}
+	dirs := d.fs.dirents(filepath.Join(d.mountpt, relpath), ss)
+	d.fs.setCount(listpath, len(dirs))
+	dirs = d.fs.renameSubtrees(dirs)
+	seen := make(map[string]bool, len(dirs))
+	var secrets []string
+	sibs := d.siblings()
+	for i, dirent := range dirs {
+		seen[dirent.Name] = true
+		if dirent.Type != fuse.DT_File {
+			continue
+		}
+		if d.fs.cfg.Fields {
+			// Secrets are presented as directories of fields, keeping
+			// the inodes they have as files.
+			dirs[i].Type = fuse.DT_Dir
+		}
+		key, err := decodeName(dirent.Name)
+		if err != nil {
+			continue
+		}
+		secrets = append(secrets, filepath.Join(relpath, key))
+		for _, sib := range sibs {
+			sibpath := siblingPath(d, filepath.Join(relpath, key), sib.kind)
+			dirs = append(dirs, d.fs.dirent(dirent.Name+sib.suffix, sib.dtype, sibpath))
+		}
+	}
+	for _, name := range d.fs.subdirs(filepath.Join(d.mountpt, relpath)) {
+		if enc := encodeName(name); !seen[enc] {
+			dirs = append(dirs, d.fs.dirent(enc, fuse.DT_Dir, filepath.Join(d.mountpt, relpath, name)))
+		}
+	}
+	if len(dirs) == 0 && d.generic {
+		return nil, fuse.ENOENT
+	}
+	d.prefetch(ctx, secrets)
+	return dirs, nil
+}
+
+// maxPrefetch is the most secrets a listing can hold for them to be
+// prefetched.  The listing is returned only once they've been read, so
+// beyond this it's quicker to leave them to the lookups, should any
+// follow.
+var maxPrefetch = 1000
+
+// prefetch reads the secrets at relpaths into the cache, a bounded number
+// at a time, so that the lookups which typically follow a readdir don't
+// each wait on Vault in turn.  Errors are left for those lookups to report.
+func (d *MountDir) prefetch(ctx context.Context, relpaths []string) {
+	// Reads of unknown engines may have side effects, such as issuing
+	// credentials, so only do this for engines we know.
+	n := d.fs.cfg.ReadDirConcurrency
+	if n <= 0 || d.fs.cfg.CacheTTL <= 0 || d.generic {
+		return
+	}
+	if len(relpaths) > maxPrefetch {
+		d.fs.cfg.Logger.Debug("too many secrets to prefetch", "mount", d.mountpt, "secrets", len(relpaths))
+		return
+	}
+	if n > len(relpaths) {
+		n = len(relpaths)
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relpath := range work {
+				_, _ = d.fs.read(ctx, filepath.Join(d.mountpt, d.pathread(relpath)))
+			}
+		}()
+	}
+loop:
+	for _, relpath := range relpaths {
+		select {
+		case work <- relpath:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(work)
+	wg.Wait()
 }
 
 func (d *MountDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
@@ -195,41 +1263,364 @@ func (d *MountDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 func lookup(ctx context.Context, d *MountDir, relpath, name string) (fs.Node, error) {
+	name, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	if base, ok := d.fs.reserved(name); ok && relpath == "" {
+		if mf := mountFiles[base]; mf != nil {
+			return mf(d)
+		}
+	}
 	childpath := filepath.Join(relpath, name)
-	// List parent to determine whether a dir or file.  We don't support
-	// the case where both "foo" and "foo/" exist.
-	ss, err := list(ctx, d.fs.client, filepath.Join(d.mountpt, d.pathlist(relpath)))
+	if _, ok := d.fs.missing.get(filepath.Join(d.mountpt, childpath)); ok {
+		return nil, fuse.ENOENT
+	}
+	// List parent to determine whether a dir or file.  Where both "foo"
+	// and "foo/" exist, the secret is found under its own name and the
+	// subtree under its name with SubtreeSuffix appended.
+	ss, err := d.fs.cachedList(ctx, filepath.Join(d.mountpt, d.pathlist(relpath)))
 	if err != nil {
 		return nil, err
 	}
-	asDir := name + "/"
+	if key := d.fs.foldName(name, ss); key != name {
+		name, childpath = key, filepath.Join(relpath, key)
+	}
+	isDir := false
 	for _, s := range ss {
 		switch s {
-		case asDir:
-			return &Dir{
-				MountDir: d,
-				path:     childpath,
-			}, nil
 		case name:
-			path := filepath.Join(d.mountpt, d.pathread(childpath))
-			sec, err := d.fs.client.Logical().Read(path)
-			if err != nil {
-				return nil, err
-			}
+			return secretNode(ctx, d, childpath)
+		case name + "/":
+			isDir = true
+		}
+	}
+	if isDir {
+		return &Dir{
+			MountDir: d,
+			path:     childpath,
+		}, nil
+	}
+	if base := d.fs.subtreeName(ss, name); base != "" {
+		return &Dir{
+			MountDir: d,
+			path:     filepath.Join(relpath, base),
+		}, nil
+	}
 
-			data := sec.Data
-			if d.mount.Type == "kv" && d.mount.Options["version"] == "2" {
-				data = data["data"].(map[string]interface{})
-			}
-			b, err := json.Marshal(data)
-			if err != nil {
-				return nil, err
-			}
-			return newFile(string(b)), nil
+	if n, err := lookupSibling(ctx, d, relpath, name, ss); n != nil || err != nil {
+		return n, err
+	}
+	if n, err := lookupAtVersion(ctx, d, relpath, name, ss); n != nil || err != nil {
+		return n, err
+	}
+
+	if d.fs.hasDir(filepath.Join(d.mountpt, childpath)) {
+		return &Dir{
+			MountDir: d,
+			path:     childpath,
+		}, nil
+	}
+	d.fs.missing.set(filepath.Join(d.mountpt, childpath), true)
+	return nil, fuse.ENOENT
+}
+
+var _ fs.NodeRemover = (*MountDir)(nil)
+
+func (d *MountDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return remove(ctx, d, "", req)
+}
+
+// remove deletes the entry name under relpath.  Vault has no real
+// directories, so removing a directory only succeeds if it's empty and
+// doesn't touch Vault.
+func remove(ctx context.Context, d *MountDir, relpath string, req *fuse.RemoveRequest) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+	ss, err := list(ctx, d.fs.client, filepath.Join(d.mountpt, d.pathlist(relpath)))
+	if err != nil {
+		return err
+	}
+	name, err := decodeName(req.Name)
+	if err != nil {
+		return fuse.ENOENT
+	}
+	want := name
+	if req.Dir {
+		if base := d.fs.subtreeName(ss, name); base != "" {
+			name = base
 		}
+		want = name + "/"
+	}
+	found := false
+	for _, s := range ss {
+		if s == want {
+			found = true
+			break
+		}
+	}
+	childpath := filepath.Join(relpath, name)
+	if !found {
+		if req.Dir && d.fs.removeDir(filepath.Join(d.mountpt, childpath)) {
+			return nil
+		}
+		return fuse.ENOENT
+	}
+
+	if req.Dir {
+		children, err := list(ctx, d.fs.client, filepath.Join(d.mountpt, d.pathlist(childpath)))
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		d.fs.removeDir(filepath.Join(d.mountpt, childpath))
+		return nil
 	}
 
-	return nil, fmt.Errorf("not found")
+	_, err = d.fs.client.Logical().Delete(ctx, filepath.Join(d.mountpt, d.pathdelete(childpath)))
+	d.invalidate(childpath)
+	return errno(err)
+}
+
+var _ fs.NodeCreater = (*MountDir)(nil)
+
+func (d *MountDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return create(ctx, d, "", req, resp)
+}
+
+// create returns an empty File for the new entry name under relpath.
+// Nothing is written to Vault until content is written and flushed, so
+// creating a file without writing to it doesn't create an empty secret.
+// Its mode is that of any other writable file, FileMode if set, and its
+// modification time is that of its creation, so that tools don't see a
+// new file dated 1970.
+func create(ctx context.Context, d *MountDir, relpath string, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+	name, err := newName(req.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.fs.missing.delete(filepath.Join(d.mountpt, relpath, name))
+	f := newSecretFile(d, filepath.Join(relpath, name), nil)
+	f.mu.Lock()
+	f.mtime = time.Now()
+	f.startWrite()
+	f.mu.Unlock()
+	return f, f, nil
+}
+
+var _ fs.NodeMkdirer = (*MountDir)(nil)
+
+func (d *MountDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	return mkdir(ctx, d, "", req)
+}
+
+// mkdir records a new directory name under relpath.  Nothing is written
+// to Vault: the path will exist there once a secret is created under it.
+func mkdir(ctx context.Context, d *MountDir, relpath string, req *fuse.MkdirRequest) (fs.Node, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	name, err := newName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	childpath := filepath.Join(relpath, name)
+	d.fs.missing.delete(filepath.Join(d.mountpt, childpath))
+	d.fs.addDir(filepath.Join(d.mountpt, childpath))
+	return &Dir{
+		MountDir: d,
+		path:     childpath,
+	}, nil
+}
+
+var _ fs.NodeRenamer = (*MountDir)(nil)
+
+func (d *MountDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	return rename(ctx, d, "", req, newDir)
+}
+
+// rename moves the secret name under relpath to newDir by copying it and
+// then deleting the original, so a failure part way leaves both rather
+// than neither.  For KV v2 only the current version is moved.  Directories
+// and moves between mounts yield EXDEV, leaving mv to copy and delete the
+// secrets one at a time.
+func rename(ctx context.Context, d *MountDir, relpath string, req *fuse.RenameRequest, newDir fs.Node) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+	var to *MountDir
+	var torel string
+	switch n := newDir.(type) {
+	case *MountDir:
+		to, torel = n, ""
+	case *Dir:
+		to, torel = n.MountDir, n.path
+	default:
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if to.fs != d.fs || to.mountpt != d.mountpt {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	oldKey, err := decodeName(req.OldName)
+	if err != nil {
+		return fuse.ENOENT
+	}
+	newKey, err := newName(req.NewName)
+	if err != nil {
+		return err
+	}
+
+	ss, err := list(ctx, d.fs.client, filepath.Join(d.mountpt, d.pathlist(relpath)))
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, s := range ss {
+		switch s {
+		case oldKey:
+			found = true
+		case oldKey + "/":
+			return fuse.Errno(syscall.EXDEV)
+		}
+	}
+	if !found {
+		return fuse.ENOENT
+	}
+
+	oldpath := filepath.Join(relpath, oldKey)
+	newpath := filepath.Join(torel, newKey)
+	d.fs.secrets.delete(filepath.Join(d.mountpt, d.pathread(oldpath)))
+	sec, err := readSecret(ctx, d, oldpath)
+	if err != nil {
+		return err
+	}
+	if err := writeSecret(ctx, d, newpath, sec.data); err != nil {
+		return err
+	}
+	_, err = d.fs.client.Logical().Delete(ctx, filepath.Join(d.mountpt, d.pathdelete(oldpath)))
+	d.invalidate(oldpath)
+	return errno(err)
+}
+
+// writeSecret writes data as the secret at relpath.
+func writeSecret(ctx context.Context, d *MountDir, relpath string, data map[string]interface{}) error {
+	if d.isKVv2() {
+		data = map[string]interface{}{
+			"data": data,
+		}
+	}
+	path := filepath.Join(d.mountpt, d.pathread(relpath))
+	var err error
+	if d.isKVv2() && d.fs.cfg.Patch {
+		err = patchSecret(ctx, d, path, data)
+	} else {
+		_, err = d.fs.client.Logical().Write(ctx, path, data)
+	}
+	d.invalidate(relpath)
+	return errno(err)
+}
+
+// secretNode returns the node presenting the secret at relpath.
+func secretNode(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	sec, err := readSecret(ctx, d, relpath)
+	if err != nil {
+		return nil, err
+	}
+	if d.fs.cfg.Fields {
+		return &SecretDir{
+			dir:  d,
+			path: relpath,
+			data: sec.data,
+		}, nil
+	}
+
+	content, rawKey, err := secretContent(d, sec)
+	if err != nil {
+		return nil, err
+	}
+	f := newSecretFile(d, relpath, content)
+	f.rawKey = rawKey
+	f.mtime = sec.mtime
+	d.fs.watch(f)
+	return f, nil
+}
+
+// secretContent returns the content of the file presenting sec, and the
+// key whose value it is if it's a raw value rather than JSON.
+func secretContent(d *MountDir, sec *secret) ([]byte, string, error) {
+	if key, value, ok := rawValue(sec.data); ok && d.fs.cfg.Raw {
+		return []byte(value), key, nil
+	}
+	b, err := d.fs.marshal(sec.data)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, "", nil
+}
+
+// secret is a secret read from a mount.
+type secret struct {
+	// data is the secret's data, unwrapped from the KV v2 envelope.
+	data map[string]interface{}
+	// mtime is when the current version was created; zero if unknown.
+	mtime time.Time
+	// resp is the full response the secret was read from, which holds
+	// the lease of dynamic secrets.
+	resp *api.Secret
+}
+
+// readSecret reads the secret at relpath.
+func readSecret(ctx context.Context, d *MountDir, relpath string) (*secret, error) {
+	path := filepath.Join(d.mountpt, d.pathread(relpath))
+	sec, err := d.fs.read(ctx, path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		// Deleted since it was listed.
+		return nil, fuse.ENOENT
+	}
+
+	if !d.isKVv2() {
+		return &secret{data: sec.Data, resp: sec}, nil
+	}
+
+	ret := &secret{resp: sec}
+	switch v := sec.Data["data"].(type) {
+	case map[string]interface{}:
+		ret.data = v
+	case nil:
+		// The latest version has been deleted.
+		return nil, fuse.ENOENT
+	default:
+		return nil, fmt.Errorf("unexpected KV v2 data at %s: %T", path, v)
+	}
+	if meta, ok := sec.Data["metadata"].(map[string]interface{}); ok {
+		if created, ok := meta["created_time"].(string); ok {
+			ret.mtime, _ = time.Parse(time.RFC3339Nano, created)
+		}
+	}
+	return ret, nil
+}
+
+// rawValue returns the key and value of data if it consists of a single
+// string value.
+func rawValue(data map[string]interface{}) (string, string, bool) {
+	if len(data) != 1 {
+		return "", "", false
+	}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			return k, s, true
+		}
+	}
+	return "", "", false
 }
 
 type Dir struct {
@@ -237,53 +1628,308 @@ type Dir struct {
 	path string
 }
 
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	mountAttr(d.MountDir, d.path, a)
+	return nil
+}
+
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return listDirents(ctx, d.fs.client, d.pathlist(filepath.Join(d.mountpt, d.path)))
+	return readDir(ctx, d.MountDir, d.path)
 }
 
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	return lookup(ctx, d.MountDir, d.path, name)
 }
 
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return remove(ctx, d.MountDir, d.path, req)
+}
+
 var _ fs.Node = (*Dir)(nil)
 
 var _ fs.NodeStringLookuper = (*Dir)(nil)
 
-func newFile(content string) *File {
-	f := &File{}
+var _ fs.NodeRemover = (*Dir)(nil)
+
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	return create(ctx, d.MountDir, d.path, req, resp)
+}
+
+var _ fs.NodeCreater = (*Dir)(nil)
+
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	return mkdir(ctx, d.MountDir, d.path, req)
+}
+
+var _ fs.NodeMkdirer = (*Dir)(nil)
+
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	return rename(ctx, d.MountDir, d.path, req, newDir)
+}
+
+var _ fs.NodeRenamer = (*Dir)(nil)
+
+// newFile returns a read-only File holding content, presenting the
+// Vault path vpath.
+func newFile(fsys *FS, vpath string, content []byte) *File {
+	f := &File{fs: fsys, vpath: vpath}
 	f.content.Store(content)
 	return f
 }
 
+// newSecretFile returns a writable File backed by the secret at path,
+// relative to the mount d.
+func newSecretFile(d *MountDir, path string, content []byte) *File {
+	f := newFile(d.fs, filepath.Join(d.mountpt, path), content)
+	f.dir = d
+	f.path = path
+	return f
+}
+
 type File struct {
+	fs *FS
+	// content holds the []byte last read from or written to Vault.  It's
+	// replaced, never modified, so reads can share it without copying.
 	content atomic.Value
+
+	// dir and path identify the secret backing the file; dir is nil for
+	// files not backed by a secret.
+	dir  *MountDir
+	path string
+
+	// write, if set, writes what's written to the file instead of the
+	// secret, which makes files without a dir writable.
+	write func(ctx context.Context, data map[string]interface{}) error
+
+	// vpath is the full Vault path the file presents, from which its
+	// inode number is derived.
+	vpath string
+
+	// mtime is the modification time, if known.
+	mtime time.Time
+
+	// rawKey is set if the content is the raw value of the secret's
+	// only key, rather than JSON.
+	rawKey string
+
+	// buf holds the pending content while the file is open for writing.
+	// It is written to Vault on flush if dirty.
+	mu    sync.Mutex
+	buf   []byte
+	dirty bool
 }
 
 var _ fs.Node = (*File)(nil)
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = 0444
-	t := f.content.Load().(string)
-	a.Size = uint64(len(t))
+	def := os.FileMode(0444)
+	if f.writable() && !f.fs.cfg.ReadOnly {
+		def = 0644
+	}
+	f.fs.fileAttr(a, f.vpath, def)
+	a.Size = f.size()
+	f.mu.Lock()
+	if !f.mtime.IsZero() {
+		a.Mtime = f.mtime
+		a.Ctime = f.mtime
+	}
+	f.mu.Unlock()
 	return nil
 }
 
+func (f *File) size() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buf != nil {
+		return uint64(len(f.buf))
+	}
+	return uint64(len(f.data()))
+}
+
+// data returns the content, which mustn't be modified.
+func (f *File) data() []byte {
+	b, _ := f.content.Load().([]byte)
+	return b
+}
+
 var _ fs.NodeOpener = (*File)(nil)
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if !req.Flags.IsReadOnly() {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	if req.Flags.IsReadOnly() {
+		resp.Flags |= fuse.OpenKeepCache
+		return f, nil
+	}
+	if !f.writable() {
 		return nil, fuse.Errno(syscall.EACCES)
 	}
-	resp.Flags |= fuse.OpenKeepCache
+	if err := f.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.startWrite()
+	f.mu.Unlock()
 	return f, nil
 }
 
+// writable reports whether f can be written to, read-only mode aside.
+func (f *File) writable() bool {
+	return f.dir != nil || f.write != nil
+}
+
+// startWrite initializes buf from the current content if no write is
+// already in progress.  Must be called with mu held.
+func (f *File) startWrite() {
+	if f.buf == nil {
+		f.buf = append([]byte{}, f.data()...)
+	}
+}
+
+var _ fs.NodeSetattrer = (*File)(nil)
+
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if !f.writable() {
+			return fuse.Errno(syscall.EACCES)
+		}
+		if err := f.fs.checkWritable(); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.startWrite()
+		if req.Size != uint64(len(f.buf)) {
+			f.buf = resize(f.buf, int(req.Size))
+			f.dirty = true
+		}
+		f.mu.Unlock()
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// resize returns b truncated or zero-extended to n bytes.
+func resize(b []byte, n int) []byte {
+	if n <= len(b) {
+		return b[:n]
+	}
+	return append(b, make([]byte, n-len(b))...)
+}
+
 var _ fs.Handle = (*File)(nil)
 
 var _ fs.HandleReader = (*File)(nil)
 
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	t := f.content.Load().(string)
-	fuseutil.HandleRead(req, resp, []byte(t))
+	f.mu.Lock()
+	if f.buf != nil {
+		fuseutil.HandleRead(req, resp, f.buf)
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.Unlock()
+	fuseutil.HandleRead(req, resp, f.data())
+	return nil
+}
+
+var _ fs.HandleWriter = (*File)(nil)
+
+func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startWrite()
+	end := int(req.Offset) + len(req.Data)
+	if end > len(f.buf) {
+		f.buf = resize(f.buf, end)
+	}
+	copy(f.buf[req.Offset:], req.Data)
+	f.dirty = true
+	resp.Size = len(req.Data)
+	if f.fs.cfg.WriteThrough {
+		// A write may be one of several making up the new content, so
+		// leave content that doesn't parse yet for flush to report.
+		if data, err := f.parse(); err == nil {
+			return f.save(ctx, data)
+		}
+	}
+	return nil
+}
+
+var _ fs.HandleFlusher = (*File)(nil)
+
+func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush(ctx)
+}
+
+var _ fs.NodeFsyncer = (*File)(nil)
+
+// Fsync writes any pending content to Vault.  Editors such as vim fsync
+// what they've saved before closing it, and give up if that fails.
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush(ctx)
+}
+
+var _ fs.HandleReleaser = (*File)(nil)
+
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.flush(ctx)
+	f.buf = nil
+	f.dirty = false
+	return err
+}
+
+// flush parses the pending content as JSON and writes it to Vault.
+// Must be called with mu held.
+func (f *File) flush(ctx context.Context) error {
+	if !f.dirty {
+		return nil
+	}
+	data, err := f.parse()
+	if err != nil {
+		return err
+	}
+	return f.save(ctx, data)
+}
+
+// parse returns the data of the pending content.  Must be called with mu
+// held.
+func (f *File) parse() (map[string]interface{}, error) {
+	if f.rawKey != "" {
+		return map[string]interface{}{
+			f.rawKey: string(f.buf),
+		}, nil
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(f.buf, &data); err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return data, nil
+}
+
+// save writes data, parsed from the pending content, to Vault.  Must be
+// called with mu held.
+func (f *File) save(ctx context.Context, data map[string]interface{}) error {
+	write := f.write
+	if write == nil {
+		write = func(ctx context.Context, data map[string]interface{}) error {
+			return writeSecret(ctx, f.dir, f.path, data)
+		}
+	}
+	if err := write(ctx, data); err != nil {
+		return err
+	}
+	// Copy, since buf is written to in place if writing continues.
+	f.content.Store(append([]byte{}, f.buf...))
+	f.dirty = false
+	if !f.mtime.IsZero() {
+		// Keep a known modification time moving forward.
+		f.mtime = time.Now()
+	}
 	return nil
 }
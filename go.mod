@@ -1,11 +1,31 @@
 module github.com/ncabatoff/fusevault
 
-go 1.12
+go 1.21
 
 require (
 	bazil.org/fuse v0.0.0-20180421153158-65cc252bf669
 	github.com/google/go-cmp v0.3.0
+	github.com/hashicorp/hcl v1.0.0
 	github.com/hashicorp/vault/api v1.0.2
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+)
+
+require (
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-cleanhttp v0.5.1 // indirect
+	github.com/hashicorp/go-multierror v1.0.0 // indirect
+	github.com/hashicorp/go-retryablehttp v0.5.3 // indirect
+	github.com/hashicorp/go-rootcerts v1.0.0 // indirect
+	github.com/hashicorp/go-sockaddr v1.0.2 // indirect
+	github.com/hashicorp/vault/sdk v0.1.8 // indirect
+	github.com/mitchellh/go-homedir v1.0.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/pierrec/lz4 v2.0.5+incompatible // indirect
+	github.com/ryanuber/go-glob v1.0.0 // indirect
 	golang.org/x/net v0.0.0-20190607181551-461777fb6f67 // indirect
 	golang.org/x/sys v0.0.0-20190608050228-5b15430b70e3 // indirect
+	golang.org/x/text v0.3.1-0.20181227161524-e6919f6577db // indirect
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// errUnmounted is reported by readiness checks once the FUSE server has
+// stopped serving.
+var errUnmounted = errors.New("filesystem is not mounted")
+
+// healthHandler answers liveness and readiness probes.  /healthz succeeds
+// whenever the process can answer at all; /readyz additionally requires
+// ready to succeed.
+func healthHandler(ready func(ctx context.Context) error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// serveHealth serves healthHandler(ready) on addr until ctx is done.
+func serveHealth(ctx context.Context, addr string, ready func(ctx context.Context) error) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: healthHandler(ready)}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return nil
+}
+
+// ready reports whether Vault is reachable with our token, using the
+// same cheap mount listing the root directory is built from.
+func (f *FS) ready(ctx context.Context) error {
+	_, err := f.client.Logical().Read(ctx, "sys/mounts")
+	return err
+}
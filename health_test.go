@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	var sealed bool
+	f, cleanup := stubfs(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		if sealed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"secret/":{"type":"kv"}}}`))
+	})
+	defer cleanup()
+
+	h := healthHandler(f.ready)
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	if got := probe("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz: got %d, want 200", got)
+	}
+	if got := probe("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz: got %d, want 200", got)
+	}
+	sealed = true
+	if got := probe("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz with Vault down: got %d, want 200", got)
+	}
+	if got := probe("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with Vault down: got %d, want 503", got)
+	}
+}
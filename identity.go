@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+// identityKinds are the identity objects presented, each as a directory
+// holding an id directory with a file per object.
+var identityKinds = []string{"entity", "group"}
+
+func makeIdentityNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &IdentityDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// IdentityDir presents an identity mount, or with kind set, the directory
+// of one kind of identity object, mirroring the API's paths.
+type IdentityDir struct {
+	fs      *FS
+	mountpt string
+	kind    string
+	dirNode
+}
+
+var _ fs.Node = (*IdentityDir)(nil)
+
+func (d *IdentityDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, d.kind), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*IdentityDir)(nil)
+
+func (d *IdentityDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if d.kind != "" {
+		return []fuse.Dirent{d.fs.dirent("id", fuse.DT_Dir, filepath.Join(d.mountpt, d.kind, "id"))}, nil
+	}
+	dirs := make([]fuse.Dirent, len(identityKinds))
+	for i, kind := range identityKinds {
+		dirs[i] = d.fs.dirent(kind, fuse.DT_Dir, filepath.Join(d.mountpt, kind))
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*IdentityDir)(nil)
+
+func (d *IdentityDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if d.kind != "" {
+		if name == "id" {
+			return &IdentityIDDir{d}, nil
+		}
+		return nil, fuse.ENOENT
+	}
+	for _, kind := range identityKinds {
+		if name == kind {
+			return &IdentityDir{fs: d.fs, mountpt: d.mountpt, kind: kind}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// IdentityIDDir lists the identity objects of one kind by ID.
+type IdentityIDDir struct {
+	*IdentityDir
+}
+
+// path returns the Vault path of the directory.
+func (d *IdentityIDDir) path() string {
+	return filepath.Join(d.mountpt, d.kind, "id")
+}
+
+func (d *IdentityIDDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.path(), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*IdentityIDDir)(nil)
+
+func (d *IdentityIDDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, d.path(), d.path())
+}
+
+var _ fs.NodeStringLookuper = (*IdentityIDDir)(nil)
+
+// Lookup returns a read-only file holding the object with the given ID
+// as JSON.
+func (d *IdentityIDDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	id, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	path := filepath.Join(d.path(), id)
+	sec, err := d.fs.read(ctx, path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, fuse.ENOENT
+	}
+	b, err := d.fs.marshal(sec.Data)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, path, b), nil
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+// A sibling is a pseudo-entry presented alongside each secret, named by
+// appending suffix to the secret's name.
+type sibling struct {
+	suffix string
+	dtype  fuse.DirentType
+	// kind is what siblingPath is given for the entry's inode path.
+	kind string
+	// lookup returns the node for the secret at relpath.
+	lookup func(ctx context.Context, d *MountDir, relpath string) (fs.Node, error)
+}
+
+// siblings returns the pseudo-entries enabled for d's secrets.
+func (d *MountDir) siblings() []sibling {
+	var sibs []sibling
+	if d.generic && d.fs.cfg.LeaseSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.LeaseSuffix,
+			dtype:  fuse.DT_File,
+			kind:   "lease",
+			lookup: lookupLease,
+		})
+	}
+	if d.fs.cfg.WrapSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.WrapSuffix,
+			dtype:  fuse.DT_File,
+			kind:   "wrapped",
+			lookup: lookupWrapped,
+		})
+	}
+	if d.fs.cfg.WarningsSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.WarningsSuffix,
+			dtype:  fuse.DT_File,
+			kind:   "warnings",
+			lookup: lookupWarnings,
+		})
+	}
+	if !d.isKVv2() {
+		return sibs
+	}
+	if d.fs.cfg.MetaSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.MetaSuffix,
+			dtype:  fuse.DT_File,
+			kind:   "meta",
+			lookup: lookupMeta,
+		})
+	}
+	if d.fs.cfg.CustomMetaSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.CustomMetaSuffix,
+			dtype:  fuse.DT_File,
+			kind:   "custom_meta",
+			lookup: lookupCustomMeta,
+		})
+	}
+	if d.fs.cfg.VersionsSuffix != "" {
+		sibs = append(sibs, sibling{
+			suffix: d.fs.cfg.VersionsSuffix,
+			dtype:  fuse.DT_Dir,
+			kind:   "versions",
+			lookup: lookupVersions,
+		})
+	}
+	return sibs
+}
+
+// siblingPath returns the path from which the inode number of the
+// pseudo-entry of the given kind for the secret at relpath, or one of its
+// fields, is derived.  NUL can't occur in a path, so it can't be mistaken
+// for a secret's.
+func siblingPath(d *MountDir, relpath, kind string) string {
+	return filepath.Join(d.mountpt, relpath) + "\x00" + kind
+}
+
+// lookupSibling returns the pseudo-entry name under relpath if it belongs
+// to one of the secrets in ss, the listing of relpath.  It returns a nil
+// node and error if name isn't a pseudo-entry.
+func lookupSibling(ctx context.Context, d *MountDir, relpath, name string, ss []string) (fs.Node, error) {
+	for _, sib := range d.siblings() {
+		if !strings.HasSuffix(name, sib.suffix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, sib.suffix)
+		for _, s := range ss {
+			if s == base {
+				return sib.lookup(ctx, d, filepath.Join(relpath, base))
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lookupMeta returns a read-only file containing the metadata of the
+// secret at relpath.
+func lookupMeta(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	sec, err := d.fs.client.Logical().Read(ctx, filepath.Join(d.mountpt, d.pathlist(relpath)))
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, fuse.ENOENT
+	}
+	b, err := d.fs.marshal(sec.Data)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, siblingPath(d, relpath, "meta"), b), nil
+}
+
+// lookupCustomMeta returns a file containing the custom metadata of the
+// secret at relpath, an empty object if it has none.  Writing the file
+// replaces the custom metadata, leaving the rest of the metadata as is.
+func lookupCustomMeta(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	metapath := filepath.Join(d.mountpt, d.pathlist(relpath))
+	sec, err := d.fs.client.Logical().Read(ctx, metapath)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil || sec.Data == nil {
+		return nil, fuse.ENOENT
+	}
+	custom, _ := sec.Data["custom_metadata"].(map[string]interface{})
+	if custom == nil {
+		custom = map[string]interface{}{}
+	}
+	b, err := d.fs.marshal(custom)
+	if err != nil {
+		return nil, err
+	}
+	f := newFile(d.fs, siblingPath(d, relpath, "custom_meta"), b)
+	f.write = func(ctx context.Context, data map[string]interface{}) error {
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		_, err := d.fs.client.Logical().Write(ctx, metapath, map[string]interface{}{
+			"custom_metadata": data,
+		})
+		d.invalidate(relpath)
+		return errno(err)
+	}
+	return f, nil
+}
+
+func lookupVersions(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	return &VersionsDir{
+		dir:  d,
+		path: relpath,
+	}, nil
+}
+
+// VersionsDir presents the versions of a KV v2 secret as a file per
+// version.
+type VersionsDir struct {
+	dir  *MountDir
+	path string
+	dirNode
+}
+
+var _ fs.Node = (*VersionsDir)(nil)
+
+func (d *VersionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.dir.fs.dirAttr(a, siblingPath(d.dir, d.path, "versions"), 0555)
+	return nil
+}
+
+// versionState is the state of a version of a KV v2 secret, as recorded
+// in the secret's metadata.
+type versionState struct {
+	// deleted is when the version was soft-deleted, or zero if it wasn't.
+	// Soft-deleted versions can be undeleted.
+	deleted time.Time
+	// destroyed is set if the version's data is gone for good.
+	destroyed bool
+}
+
+// versionStates returns the state of each version of the secret at
+// relpath, keyed by version number.
+func versionStates(ctx context.Context, d *MountDir, relpath string) (map[string]versionState, error) {
+	sec, err := d.fs.client.Logical().Read(ctx, filepath.Join(d.mountpt, d.pathlist(relpath)))
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		return nil, fuse.ENOENT
+	}
+	versions, _ := sec.Data["versions"].(map[string]interface{})
+	states := make(map[string]versionState, len(versions))
+	for v, meta := range versions {
+		meta, _ := meta.(map[string]interface{})
+		states[v] = parseVersionState(meta)
+	}
+	return states, nil
+}
+
+// parseVersionState returns the state recorded in meta, the metadata of
+// a single version.
+func parseVersionState(meta map[string]interface{}) versionState {
+	var st versionState
+	if t, ok := meta["deletion_time"].(string); ok && t != "" {
+		st.deleted, _ = time.Parse(time.RFC3339Nano, t)
+	}
+	st.destroyed, _ = meta["destroyed"].(bool)
+	return st
+}
+
+// versions returns the secret's version numbers in ascending order,
+// omitting destroyed versions.
+func (d *VersionsDir) versions(ctx context.Context) ([]string, error) {
+	states, err := versionStates(ctx, d.dir, d.path)
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]string, 0, len(states))
+	for v, st := range states {
+		if !st.destroyed {
+			vs = append(vs, v)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		vi, _ := strconv.Atoi(vs[i])
+		vj, _ := strconv.Atoi(vs[j])
+		return vi < vj
+	})
+	return vs, nil
+}
+
+var _ fs.HandleReadDirAller = (*VersionsDir)(nil)
+
+func (d *VersionsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	vs, err := d.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]fuse.Dirent, len(vs))
+	for i, v := range vs {
+		dirs[i] = d.dir.fs.dirent(v, fuse.DT_File, filepath.Join(siblingPath(d.dir, d.path, "versions"), v))
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*VersionsDir)(nil)
+
+func (d *VersionsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return lookupVersion(ctx, d.dir, d.path, name)
+}
+
+// lookupVersion returns a read-only file containing the given version of
+// the secret at relpath.  A soft-deleted version yields an empty
+// DeletedVersion placeholder; versions that don't exist or have been
+// destroyed yield ENOENT.
+func lookupVersion(ctx context.Context, d *MountDir, relpath, version string) (fs.Node, error) {
+	if n, err := strconv.Atoi(version); err != nil || n < 1 {
+		return nil, fuse.ENOENT
+	}
+	vpath := filepath.Join(siblingPath(d, relpath, "versions"), version)
+	path, query := kvv2PathAdjustor{}.pathversion(relpath, version)
+	sec, err := d.fs.client.Logical().ReadWithData(ctx, filepath.Join(d.mountpt, path), query)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if sec == nil {
+		return nil, fuse.ENOENT
+	}
+	data, ok := sec.Data["data"].(map[string]interface{})
+	if !ok {
+		// Reads of deleted and destroyed versions return no data, but do
+		// return the version's metadata.
+		meta, _ := sec.Data["metadata"].(map[string]interface{})
+		st := parseVersionState(meta)
+		if st.destroyed || st.deleted.IsZero() {
+			return nil, fuse.ENOENT
+		}
+		return &DeletedVersion{fs: d.fs, vpath: vpath, deleted: st.deleted}, nil
+	}
+	b, err := d.fs.marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, vpath, b), nil
+}
+
+// DeletedVersion is the placeholder for a soft-deleted version of a KV v2
+// secret.  It's empty, with the deletion time as its mtime and in the
+// user.vault.deletion_time extended attribute.
+type DeletedVersion struct {
+	fs      *FS
+	vpath   string
+	deleted time.Time
+}
+
+var _ fs.Node = (*DeletedVersion)(nil)
+
+func (f *DeletedVersion) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.fs.fileAttr(a, f.vpath, 0444)
+	a.Mtime = f.deleted
+	a.Ctime = f.deleted
+	return nil
+}
+
+var _ fs.NodeOpener = (*DeletedVersion)(nil)
+
+func (f *DeletedVersion) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if err := checkNotDir(req); err != nil {
+		return nil, err
+	}
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	return f, nil
+}
+
+var _ fs.HandleReadAller = (*DeletedVersion)(nil)
+
+func (f *DeletedVersion) ReadAll(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *DeletedVersion) xattrs() map[string]string {
+	return map[string]string{
+		xattrPrefix + "deletion_time": f.deleted.Format(time.RFC3339Nano),
+	}
+}
+
+var _ fs.NodeListxattrer = (*DeletedVersion)(nil)
+
+func (f *DeletedVersion) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(f.xattrs(), req, resp)
+}
+
+var _ fs.NodeGetxattrer = (*DeletedVersion)(nil)
+
+func (f *DeletedVersion) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(f.xattrs(), req, resp)
+}
+
+// lookupAtVersion returns the version of a secret in ss, the listing of
+// relpath, requested by a name of the form "foo@3".  It returns a nil node
+// and error if name isn't of that form.
+func lookupAtVersion(ctx context.Context, d *MountDir, relpath, name string, ss []string) (fs.Node, error) {
+	i := strings.LastIndex(name, "@")
+	if !d.isKVv2() || i < 0 {
+		return nil, nil
+	}
+	base, version := name[:i], name[i+1:]
+	for _, s := range ss {
+		if s == base {
+			return lookupVersion(ctx, d, filepath.Join(relpath, base), version)
+		}
+	}
+	return nil, nil
+}
+
+// xattrPrefix is prepended to the names of the extended attributes
+// presenting KV v2 metadata.  Unprivileged users may only see the user
+// namespace.
+const xattrPrefix = "user.vault."
+
+// xattrs returns the extended attributes of f: for KV v2 secrets, the
+// metadata of the current version, along with any custom metadata.
+func (f *File) xattrs(ctx context.Context) (map[string]string, error) {
+	if f.dir == nil || !f.dir.isKVv2() {
+		return nil, nil
+	}
+	sec, err := readSecret(ctx, f.dir, f.path)
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := sec.resp.Data["metadata"].(map[string]interface{})
+	attrs := make(map[string]string, len(meta))
+	for k, v := range meta {
+		switch v := v.(type) {
+		case nil:
+		case map[string]interface{}:
+			if k != "custom_metadata" {
+				continue
+			}
+			for ck, cv := range v {
+				attrs[xattrPrefix+"custom_metadata."+ck] = fmt.Sprint(cv)
+			}
+		default:
+			attrs[xattrPrefix+k] = fmt.Sprint(v)
+		}
+	}
+	return attrs, nil
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	attrs, err := f.xattrs(ctx)
+	if err != nil {
+		return err
+	}
+	return listxattr(attrs, req, resp)
+}
+
+// listxattr answers req with the names of attrs.
+func listxattr(attrs map[string]string, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	if req.Size != 0 && uint32(len(resp.Xattr)) > req.Size {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	attrs, err := f.xattrs(ctx)
+	if err != nil {
+		return err
+	}
+	return getxattr(attrs, req, resp)
+}
+
+// getxattr answers req with the value in attrs of the attribute named.
+func getxattr(attrs map[string]string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	v, ok := attrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(v)
+	if req.Size != 0 && uint32(len(resp.Xattr)) > req.Size {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+// patchSecret merges data, a KV v2 write request, into the secret whose
+// data path is path.  Secrets that don't exist yet are written as usual.
+// Vault before 1.9 can't patch, so for it the current data is read and
+// merged here, with check-and-set guarding against any write in between.
+func patchSecret(ctx context.Context, d *MountDir, path string, data map[string]interface{}) error {
+	_, err := d.fs.client.Logical().Patch(ctx, path, data)
+	rerr, ok := err.(*responseError)
+	switch {
+	case err == nil:
+		return nil
+	case ok && rerr.StatusCode == http.StatusNotFound:
+		_, err = d.fs.client.Logical().Write(ctx, path, data)
+		return err
+	case !ok || rerr.StatusCode != http.StatusMethodNotAllowed:
+		return err
+	}
+
+	sec, err := d.fs.client.Logical().Read(ctx, path)
+	if err != nil {
+		return err
+	}
+	merged := map[string]interface{}{}
+	version := 0.0
+	if sec != nil {
+		if cur, ok := sec.Data["data"].(map[string]interface{}); ok {
+			merged = cur
+		}
+		meta, _ := sec.Data["metadata"].(map[string]interface{})
+		if v, ok := meta["version"].(json.Number); ok {
+			version, _ = v.Float64()
+		}
+	}
+	for k, v := range data["data"].(map[string]interface{}) {
+		merged[k] = v
+	}
+	_, err = d.fs.client.Logical().Write(ctx, path, map[string]interface{}{
+		"data":    merged,
+		"options": map[string]interface{}{"cas": int(version)},
+	})
+	return err
+}
+
+// isKVv2 reports whether the KV mount at mountpt is version 2.  The
+// version option says so, if it's set; otherwise the mount is probed,
+// with the answer remembered so that's done once.
+func (f *FS) isKVv2(ctx context.Context, mountpt string, mount *api.MountOutput) bool {
+	switch strings.TrimSpace(mount.Options["version"]) {
+	case "1":
+		return false
+	case "2":
+		return true
+	}
+	f.mu.Lock()
+	v2, ok := f.kvv2[mountpt]
+	f.mu.Unlock()
+	if ok {
+		return v2
+	}
+	v2 = f.probeKVv2(ctx, mountpt)
+	f.cfg.Logger.Debug("detected KV version", "mount", mountpt, "v2", v2)
+	f.mu.Lock()
+	f.kvv2[mountpt] = v2
+	f.mu.Unlock()
+	return v2
+}
+
+// probeKVv2 reports whether the KV mount at mountpt behaves as version 2.
+// It asks Vault for the mount's options as the Vault CLI does, which any
+// token with access to the mount may do, and failing that, tries listing
+// the mount's metadata, which only a version 2 mount with secrets has.
+func (f *FS) probeKVv2(ctx context.Context, mountpt string) bool {
+	sec, err := f.client.Logical().Read(ctx, path.Join("sys/internal/ui/mounts", mountpt))
+	if err == nil && sec != nil {
+		opts, _ := sec.Data["options"].(map[string]interface{})
+		if v, ok := opts["version"].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v) == "2"
+		}
+		if typ, _ := sec.Data["type"].(string); typ == "kv" {
+			return false
+		}
+	}
+	keys, err := list(ctx, f.client, path.Join(mountpt, "metadata"))
+	return err == nil && len(keys) > 0
+}
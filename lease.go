@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+// leaseInfo is the content of a lease sibling file.
+type leaseInfo struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// lookupLease returns a read-only file describing the lease of the secret
+// at relpath.  It's taken from the cached response where possible, so
+// that it matches the credentials just read from the secret itself.
+func lookupLease(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	sec, err := readSecret(ctx, d, relpath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.fs.marshal(leaseInfo{
+		LeaseID:       sec.resp.LeaseID,
+		LeaseDuration: sec.resp.LeaseDuration,
+		Renewable:     sec.resp.Renewable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, siblingPath(d, relpath, "lease"), b), nil
+}
+
+// leaseTracker keeps the leases handed out by reads of dynamic secrets,
+// keyed by lease ID, so that they can be renewed and revoked from the
+// leases control directory.  It's shared with child namespaces.
+type leaseTracker struct {
+	mu     sync.Mutex
+	leases map[string]*issuedLease
+}
+
+// issuedLease is a lease handed out, and the content of its file in the
+// leases directory.
+type issuedLease struct {
+	leaseInfo
+	// Path is the Vault path whose read issued the lease.
+	Path string `json:"path"`
+	// Expires is when the lease runs out, nil if it doesn't.
+	Expires *time.Time `json:"expires,omitempty"`
+	// fs is the FS of the namespace the lease belongs to.
+	fs *FS
+}
+
+func newLeaseTracker() *leaseTracker {
+	return &leaseTracker{leases: make(map[string]*issuedLease)}
+}
+
+// track records the lease of sec, read from path, if it has one.
+func (f *FS) track(path string, sec *api.Secret) {
+	if sec == nil || sec.LeaseID == "" {
+		return
+	}
+	l := &issuedLease{
+		leaseInfo: leaseInfo{LeaseID: sec.LeaseID, LeaseDuration: sec.LeaseDuration, Renewable: sec.Renewable},
+		Path:      path,
+		fs:        f,
+	}
+	l.extend(sec.LeaseDuration)
+	f.issued.mu.Lock()
+	f.issued.leases[l.LeaseID] = l
+	f.issued.mu.Unlock()
+}
+
+// extend has l expire ttl seconds from now.  Must be called with the
+// tracker's mu held if l is in it.
+func (l *issuedLease) extend(ttl int) {
+	l.LeaseDuration = ttl
+	l.Expires = nil
+	if ttl > 0 {
+		expires := time.Now().Add(time.Duration(ttl) * time.Second).UTC().Truncate(time.Second)
+		l.Expires = &expires
+	}
+}
+
+// current returns the leases that haven't expired, by ID, dropping those
+// that have.
+func (t *leaseTracker) current() map[string]issuedLease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	leases := make(map[string]issuedLease, len(t.leases))
+	for id, l := range t.leases {
+		if l.Expires != nil && now.After(*l.Expires) {
+			delete(t.leases, id)
+			continue
+		}
+		leases[id] = *l
+	}
+	return leases
+}
+
+// leasePath returns the path from which the inode number of the file in
+// the leases directory for the lease id is derived.
+func leasePath(id string) string {
+	return "\x00leases/" + id
+}
+
+// LeasesDir is the control directory holding a file for each lease handed
+// out and not yet expired or revoked.  Each holds the lease as JSON;
+// writing "renew" to it renews the lease, after which it holds the renewed
+// lease, and writing "revoke" revokes it, so that its path is read afresh
+// rather than from a cache.  Both modify Vault, so fail with EROFS when
+// read-only.
+type LeasesDir struct {
+	fs *FS
+	dirNode
+}
+
+func leasesDir(d *RootDir) fs.Node {
+	return &LeasesDir{fs: d.fs}
+}
+
+var _ fs.Node = (*LeasesDir)(nil)
+
+func (d *LeasesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, "\x00leases", 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*LeasesDir)(nil)
+
+func (d *LeasesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	leases := d.fs.issued.current()
+	ids := make([]string, 0, len(leases))
+	for id := range leases {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	dirs := make([]fuse.Dirent, len(ids))
+	for i, id := range ids {
+		dirs[i] = d.fs.dirent(encodeName(id), fuse.DT_File, leasePath(id))
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*LeasesDir)(nil)
+
+func (d *LeasesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	id, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	l, ok := d.fs.issued.current()[id]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	b, err := d.fs.marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	o := d.fs.opFile(leasePath(id), func(ctx context.Context, in []byte) ([]byte, error) {
+		return d.manage(ctx, id, strings.TrimSpace(string(in)))
+	})
+	o.mu.Lock()
+	if !o.writing {
+		o.out = b
+	}
+	o.mu.Unlock()
+	return o, nil
+}
+
+// manage renews or revokes the lease id as cmd says, returning the lease
+// as it then is.  In a dry run the lease is left as it was.
+func (d *LeasesDir) manage(ctx context.Context, id, cmd string) ([]byte, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	t := d.fs.issued
+	t.mu.Lock()
+	l, ok := t.leases[id]
+	var unchanged issuedLease
+	if ok {
+		unchanged = *l
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	switch cmd {
+	case "renew":
+		sec, err := l.fs.client.Logical().Write(ctx, "sys/leases/renew", map[string]interface{}{"lease_id": id})
+		if err != nil {
+			return nil, errno(err)
+		}
+		if d.fs.cfg.DryRun {
+			return d.fs.marshal(unchanged)
+		}
+		t.mu.Lock()
+		if sec != nil {
+			l.Renewable = sec.Renewable
+			l.extend(sec.LeaseDuration)
+		}
+		renewed := *l
+		t.mu.Unlock()
+		return d.fs.marshal(renewed)
+	case "revoke":
+		if _, err := l.fs.client.Logical().Write(ctx, "sys/leases/revoke", map[string]interface{}{"lease_id": id}); err != nil {
+			return nil, errno(err)
+		}
+		if d.fs.cfg.DryRun {
+			return d.fs.marshal(unchanged)
+		}
+		t.mu.Lock()
+		delete(t.leases, id)
+		t.mu.Unlock()
+		// Don't go on serving the revoked credentials from the caches.
+		l.fs.secrets.delete(l.Path)
+		l.fs.diskDelete("read", l.Path)
+		d.fs.mu.Lock()
+		delete(d.fs.opFiles, leasePath(id))
+		d.fs.mu.Unlock()
+		return nil, nil
+	}
+	return nil, fuse.Errno(syscall.EINVAL)
+}
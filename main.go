@@ -5,7 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -19,17 +26,65 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func run(ctx context.Context, mountpoint string) (error, chan error) {
-	c, filesys, err := start(mountpoint)
+func run(ctx context.Context, mountpoint string, cfg Config) (error, chan error) {
+	c, filesys, err := start(mountpoint, cfg)
 	if err != nil {
 		return err, nil
 	}
 
 	srv := fs.New(c, nil)
 
+	if cfg.MetricsAddr != "" {
+		if err := serveMetrics(ctx, cfg.MetricsAddr); err != nil {
+			_ = fuse.Unmount(mountpoint)
+			_ = c.Close()
+			return err, nil
+		}
+	}
+
+	served := make(chan struct{})
+	if cfg.HealthAddr != "" {
+		ready := func(ctx context.Context) error {
+			select {
+			case <-served:
+				return errUnmounted
+			default:
+			}
+			return filesys.ready(ctx)
+		}
+		if err := serveHealth(ctx, cfg.HealthAddr, ready); err != nil {
+			_ = fuse.Unmount(mountpoint)
+			_ = c.Close()
+			return err, nil
+		}
+	}
+
+	if cfg.TokenFile != "" {
+		go filesys.watchTokenFile(ctx, cfg.TokenFile, tokenFileInterval)
+	}
+	if files := credentialFiles(cfg); len(files) > 0 {
+		go filesys.watchCredentials(ctx, files, tokenFileInterval)
+	}
+
+	if cfg.PollInterval > 0 {
+		go filesys.pollChanges(ctx, srv, cfg.PollInterval)
+	}
+
+	go func() {
+		err := renewToken(ctx, filesys.client, cfg.RenewInterval)
+		if err != nil {
+			filesys.cfg.Logger.Error("token renewal stopped", "error", err)
+			if cfg.UnmountOnExpiry {
+				_ = fuse.Unmount(mountpoint)
+			}
+		}
+	}()
+
 	var ret = make(chan error)
 	go func() {
-		ret <- srv.Serve(filesys)
+		err := srv.Serve(filesys)
+		close(served)
+		ret <- err
 		_ = fuse.Unmount(mountpoint)
 		_ = c.Close()
 	}()
@@ -45,19 +100,30 @@ func run(ctx context.Context, mountpoint string) (error, chan error) {
 	return c.MountError, ret
 }
 
-func start(mountpoint string) (*fuse.Conn, *FS, error) {
-	c, err := fuse.Mount(
-		mountpoint,
+func start(mountpoint string, cfg Config) (*fuse.Conn, *FS, error) {
+	options := []fuse.MountOption{
 		fuse.FSName("vaultfs"),
 		fuse.Subtype("vaultfs"),
 		fuse.LocalVolume(),
 		fuse.VolumeName("Vault filesystem"),
-	)
+	}
+	if cfg.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if cfg.MkdirMode != 0 {
+		if err := makeMountpoint(mountpoint, cfg.MkdirMode); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := checkMountpoint(mountpoint, cfg.Force); err != nil {
+		return nil, nil, err
+	}
+	c, err := fuse.Mount(mountpoint, options...)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	filesys, err := NewFS()
+	filesys, err := NewFS(cfg)
 	if err != nil {
 		_ = fuse.Unmount(mountpoint)
 		_ = c.Close()
@@ -67,31 +133,241 @@ func start(mountpoint string) (*fuse.Conn, *FS, error) {
 	return c, filesys, nil
 }
 
-var debug bool
+// stringList is a flag.Value collecting comma-separated values, which may
+// also be given by repeating the flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// stringMap is a flag.Value collecting comma-separated key=value pairs,
+// which may also be given by repeating the flag.
+type stringMap map[string]string
+
+func (m stringMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m stringMap) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("%q isn't of the form key=value", pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+// parseMode parses an octal permission mode, returning zero for the empty
+// string.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q: %v", s, err)
+	}
+	if m&^0777 != 0 {
+		return 0, fmt.Errorf("invalid mode %q: only permission bits may be set", s)
+	}
+	return os.FileMode(m), nil
+}
 
 func main() {
 	var (
 		flagDebug     = flag.Bool("debug", false, "enable debugging")
 		flagDebugFuse = flag.Bool("debugfuse", false, "enable FUSE debugging")
+		flagFields    = flag.Bool("fields", false, "present each secret as a directory with a file per key, decoding values of the form base64:<data>")
+		flagTree      = flag.Bool("tree", false, "like -fields, but present objects nested in secrets as directories too")
+		flagRaw       = flag.Bool("raw", false, "serve secrets with a single string value as that value instead of JSON")
+		flagIndent    = flag.Bool("indent", false, "pretty-print JSON secret contents")
+		flagMeta      = flag.String("meta-suffix", ".meta", "suffix of the sibling file holding KV v2 secret metadata; empty to disable")
+		flagCustom    = flag.String("custom-meta-suffix", ".custom_meta", "suffix of the sibling file holding KV v2 secret custom metadata, writable unless -read-only; empty to disable")
+		flagVersions  = flag.String("versions-suffix", ".versions", "suffix of the sibling directory holding KV v2 secret versions; empty to disable")
+		flagWrap      = flag.String("wrap-suffix", "", "suffix of the sibling file holding a new response-wrapping token for the secret each time it's read; empty to disable")
+		flagWrapTTL   = flag.Duration("wrap-ttl", 5*time.Minute, "how long the tokens read from -wrap-suffix files are valid")
+		flagWarnings  = flag.String("warnings-suffix", "", "suffix of the sibling file holding the request ID and warnings of the response the secret was read from; empty to disable")
+		flagLease     = flag.String("lease-suffix", ".lease", "suffix of the sibling file holding the lease of dynamic secrets; empty to disable")
+		flagSubtree   = flag.String("subtree-suffix", ".d", "suffix of the directory holding a subtree that shares its name with a secret; empty to hide such subtrees")
+		flagTokenFile = flag.String("token-file", "", "file holding the Vault token, e.g. ~/.vault-token, re-read when it changes; by default VAULT_TOKEN is used")
+		flagAuth      = flag.String("auth", "", "auth method to log in with: approle, aws or cert; by default VAULT_TOKEN is used")
+		flagRoleID    = flag.String("role-id", "", "AppRole role ID, or @file to read it from a file")
+		flagSecretID  = flag.String("secret-id", "", "AppRole secret ID, or @file to read it from a file")
+		flagCert      = flag.String("client-cert", "", "PEM file of the TLS client certificate to present, e.g. for -auth cert")
+		flagKey       = flag.String("client-key", "", "PEM file of the private key of -client-cert")
+		flagCACert    = flag.String("ca-cert", "", "PEM file of the CA certificates to verify Vault's certificate with")
+		flagInsecure  = flag.Bool("tls-skip-verify", false, "don't verify Vault's TLS certificate; for testing only")
+		flagAWSRole   = flag.String("aws-role", "", "Vault role to log in as with -auth aws; by default the role named after the IAM principal")
+		flagRenew     = flag.Duration("renew-interval", 0, "how often to renew the Vault token; 0 means at half its TTL")
+		flagExpiry    = flag.Bool("unmount-on-expiry", false, "unmount once the Vault token can no longer be renewed")
+		flagListTTL   = flag.Duration("list-cache-ttl", time.Second, "how long to cache directory listings used by lookups; 0 disables")
+		flagCacheTTL  = flag.Duration("cache-ttl", 5*time.Second, "how long to cache secret contents; 0 disables")
+		flagCacheDir  = flag.String("cache-dir", "", "directory to keep encrypted copies of the secrets read in, to serve if Vault becomes unreachable; anyone who can read it and knows the token (or -cache-passphrase) can read them, even after unmounting")
+		flagDirTTL    = flag.Duration("cache-dir-ttl", 15*time.Minute, "how long after being read copies in -cache-dir can be served")
+		flagCachePass = flag.String("cache-passphrase", "", "passphrase to derive the -cache-dir key from instead of the token, so that copies survive a change of token; @FILE reads it from FILE")
+		flagNegTTL    = flag.Duration("negative-cache-ttl", 5*time.Second, "how long to remember that a looked up name doesn't exist; 0 disables")
+		flagCounts    = flag.Bool("entry-counts", false, "report a directory's size as its number of entries when last listed")
+		flagReadDirN  = flag.Int("readdir-concurrency", 8, "how many secrets to read at once when prefetching a listed directory into the cache; 0 disables")
+		flagPoll      = flag.Duration("poll-interval", 0, "how often to re-read secrets cached by the kernel to pick up changes made elsewhere; 0 disables")
+		flagNamespace = flag.String("namespace", "", "Vault Enterprise namespace to operate within")
+		flagAllow     = flag.Bool("allow-other", false, "allow other users to access the mount; requires user_allow_other in /etc/fuse.conf unless root")
+		flagForce     = flag.Bool("force", false, "lazily unmount a FUSE filesystem already mounted on the mountpoint, e.g. a stale mount, before mounting")
+		flagFileMode  = flag.String("file-mode", "", "octal permission bits for files, e.g. 0400; defaults to 0444, or 0644 for writable secrets")
+		flagMkdir     = flag.Bool("mkdir", false, "create the mountpoint if it doesn't exist")
+		flagMkdirMode = flag.String("mkdir-mode", "0755", "octal permission bits for the mountpoint created by -mkdir")
+		flagDirMode   = flag.String("dir-mode", "", "octal permission bits for directories, e.g. 0500; defaults to 0555, or 0755 where writable")
+		flagUid       = flag.Uint("uid", uint(os.Getuid()), "owner uid reported for all files")
+		flagGid       = flag.Uint("gid", uint(os.Getgid()), "owner gid reported for all files")
+		flagRetries   = flag.Int("retries", 2, "how many times to retry Vault requests failing with a 5xx status or a network error")
+		flagMaxConc   = flag.Int("max-concurrency", 32, "how many Vault requests can be in progress at once, the rest waiting their turn; 0 means no limit")
+		flagTimeout   = flag.Duration("request-timeout", 30*time.Second, "how long to wait on a Vault request, including retries, before failing with EAGAIN; 0 means no limit")
+		flagReadOnly  = flag.Bool("read-only", true, "reject all modifications to Vault")
+		flagDryRun    = flag.Bool("dry-run", false, "log the writes and deletes modifications would make of Vault, and have them succeed without making them; implies -read-only=false")
+		flagPatch     = flag.Bool("patch", false, "merge what's written to KV v2 secrets into their current data, keeping keys left out")
+		flagReserved  = flag.String("reserved-prefix", defaultReservedPrefix, "prefix of the unlisted control files at the root (flush, leases, raw, token, unwrap) and at the top of each mount (mount); change it if it clashes with your secrets")
+		flagWriteThru = flag.Bool("write-through", false, "write a file's content to Vault after every write to it that leaves valid content, not just when it's closed; multiplies Vault requests")
+		flagMetrics   = flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. :9090")
+		flagMount     = flag.String("mount", "", "the one mount to expose, presented at the mountpoint itself rather than as a directory of it")
+		flagCaseFold  = flag.Bool("case-insensitive", false, "have lookups of mounts and keys that aren't found find those differing only by case, as on macOS; ambiguous names are logged")
+		flagBrowse    = flag.Bool("browse-unsupported", false, "expose mounts of engines without specific support, browsing them with LIST and READ like KV v1; by default they're hidden")
+		flagHealth    = flag.String("health-addr", "", "address to serve /healthz and /readyz probes on, e.g. :8080")
+		flagConfig    = flag.String("config", "", "JSON or HCL file of settings keyed by flag name; flags given on the command line override it")
 	)
+	var addrs, mountAllow, mountDeny stringList
+	flag.Var(&addrs, "vault-addr", "comma-separated Vault addresses to fail over between, overriding VAULT_ADDR; may be repeated")
+	flag.Var(&mountAllow, "mount-allow", "comma-separated mounts to expose, excluding all others; may be repeated")
+	flag.Var(&mountDeny, "mount-deny", "comma-separated mounts not to expose; may be repeated")
+	mountNamespaces := make(stringMap)
+	flag.Var(mountNamespaces, "mount-namespace", "comma-separated MOUNT=NAMESPACE pairs, showing the mount of that name in that namespace (relative to -namespace) among the others; may be repeated")
 	flag.Usage = usage
 	flag.Parse()
+	if *flagConfig != "" {
+		if err := loadConfigFile(flag.CommandLine, *flagConfig); err != nil {
+			log.Fatalf("-config: %v", err)
+		}
+	}
+	level := slog.LevelInfo
 	if *flagDebug {
-		debug = true
+		level = slog.LevelDebug
 	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
 	if *flagDebugFuse {
 		fuse.Debug = func(msg interface{}) {
 			log.Println(msg)
 		}
 	}
 
+	fileMode, err := parseMode(*flagFileMode)
+	if err != nil {
+		log.Fatalf("-file-mode: %v", err)
+	}
+	dirMode, err := parseMode(*flagDirMode)
+	if err != nil {
+		log.Fatalf("-dir-mode: %v", err)
+	}
+	var mkdirMode os.FileMode
+	if *flagMkdir {
+		if mkdirMode, err = parseMode(*flagMkdirMode); err != nil {
+			log.Fatalf("-mkdir-mode: %v", err)
+		}
+		if mkdirMode == 0 {
+			log.Fatalf("-mkdir-mode: no permission bits set")
+		}
+	}
+
 	if flag.NArg() != 1 {
 		usage()
 		os.Exit(2)
 	}
 	mountpoint := flag.Arg(0)
 
-	err, cerr := run(context.Background(), mountpoint)
+	cfg := Config{
+		Logger:             logger,
+		Namespace:          *flagNamespace,
+		Addresses:          addrs,
+		AllowOther:         *flagAllow,
+		Force:              *flagForce,
+		MkdirMode:          mkdirMode,
+		FileMode:           fileMode,
+		DirMode:            dirMode,
+		Uid:                uint32(*flagUid),
+		Gid:                uint32(*flagGid),
+		MetricsAddr:        *flagMetrics,
+		HealthAddr:         *flagHealth,
+		BrowseUnsupported:  *flagBrowse,
+		CaseInsensitive:    *flagCaseFold,
+		ReadOnly:           *flagReadOnly && !*flagDryRun,
+		DryRun:             *flagDryRun,
+		WriteThrough:       *flagWriteThru,
+		Patch:              *flagPatch,
+		ReservedPrefix:     *flagReserved,
+		MaxConcurrency:     *flagMaxConc,
+		Retries:            *flagRetries,
+		RequestTimeout:     *flagTimeout,
+		Fields:             *flagFields,
+		Raw:                *flagRaw,
+		Tree:               *flagTree,
+		Indent:             *flagIndent,
+		Mount:              *flagMount,
+		MountNamespaces:    mountNamespaces,
+		MountAllow:         mountAllow,
+		MountDeny:          mountDeny,
+		MetaSuffix:         *flagMeta,
+		CustomMetaSuffix:   *flagCustom,
+		VersionsSuffix:     *flagVersions,
+		LeaseSuffix:        *flagLease,
+		WrapSuffix:         *flagWrap,
+		WrapTTL:            *flagWrapTTL,
+		WarningsSuffix:     *flagWarnings,
+		SubtreeSuffix:      *flagSubtree,
+		TokenFile:          *flagTokenFile,
+		Auth:               *flagAuth,
+		RoleID:             *flagRoleID,
+		SecretID:           *flagSecretID,
+		AWSRole:            *flagAWSRole,
+		ClientCert:         *flagCert,
+		ClientKey:          *flagKey,
+		CACert:             *flagCACert,
+		TLSSkipVerify:      *flagInsecure,
+		RenewInterval:      *flagRenew,
+		UnmountOnExpiry:    *flagExpiry,
+		ListCacheTTL:       *flagListTTL,
+		CacheTTL:           *flagCacheTTL,
+		CacheDir:           *flagCacheDir,
+		CacheDirTTL:        *flagDirTTL,
+		CachePassphrase:    *flagCachePass,
+		NegativeCacheTTL:   *flagNegTTL,
+		ReadDirConcurrency: *flagReadDirN,
+		EntryCounts:        *flagCounts,
+		PollInterval:       *flagPoll,
+	}
+
+	// Cancelling the context unmounts, so that a signal doesn't leave a
+	// dead mount behind.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err, cerr := run(ctx, mountpoint, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the Vault request
+// latency histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// vaultMetrics records every Vault call made through vaultlog.
+var vaultMetrics = newMetrics()
+
+type requestKey struct {
+	op     string
+	status string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// metrics holds request counts and latencies, served in the Prometheus
+// text exposition format.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+// observe records a call to Vault.  status is the HTTP status of the
+// response, or zero if there was none.
+func (m *metrics) observe(op string, status int, d time.Duration) {
+	statusLabel := "error"
+	if status != 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{op, statusLabel}]++
+	h := m.latency[op]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[op] = h
+	}
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].status < keys[j].status
+	})
+	fmt.Fprintln(w, "# HELP fusevault_vault_requests_total Vault API requests by operation and response status.")
+	fmt.Fprintln(w, "# TYPE fusevault_vault_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "fusevault_vault_requests_total{op=%q,status=%q} %d\n", k.op, k.status, m.requests[k])
+	}
+
+	ops := make([]string, 0, len(m.latency))
+	for op := range m.latency {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Fprintln(w, "# HELP fusevault_vault_request_duration_seconds Vault API request latency by operation.")
+	fmt.Fprintln(w, "# TYPE fusevault_vault_request_duration_seconds histogram")
+	for _, op := range ops {
+		h := m.latency[op]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "fusevault_vault_request_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, le, cum)
+		}
+		fmt.Fprintf(w, "fusevault_vault_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(w, "fusevault_vault_request_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(w, "fusevault_vault_request_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// serveMetrics serves vaultMetrics at /metrics on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", vaultMetrics)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// checkMountpoint returns an error saying what to do if mountpoint can't
+// be mounted on: it must be an existing, empty directory that no FUSE
+// filesystem is mounted on already.  Other mounts, such as an empty tmpfs,
+// are mounted over.  With force, a FUSE filesystem mounted there, like the
+// stale mount of an instance that didn't exit cleanly, is lazily
+// unmounted first.
+func checkMountpoint(mountpoint string, force bool) error {
+	mounted, err := isMounted(mountpoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if !force {
+			return fmt.Errorf("%s is already mounted on, perhaps by an instance that exited uncleanly; unmount it or pass -force", mountpoint)
+		}
+		if err := lazyUnmount(mountpoint); err != nil {
+			return fmt.Errorf("unmounting %s: %v", mountpoint, err)
+		}
+	}
+
+	fi, err := os.Stat(mountpoint)
+	if err != nil {
+		return fmt.Errorf("mountpoint: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("mountpoint %s is not a directory", mountpoint)
+	}
+	d, err := os.Open(mountpoint)
+	if err != nil {
+		return fmt.Errorf("mountpoint: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Readdirnames(1); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("mountpoint %s is not empty", mountpoint)
+		}
+		return fmt.Errorf("mountpoint: %v", err)
+	}
+	return nil
+}
+
+// makeMountpoint creates mountpoint and any missing parents with the
+// given permission bits, unless it exists already.  An existing
+// mountpoint is left as it is, for checkMountpoint to reject if need be.
+func makeMountpoint(mountpoint string, mode os.FileMode) error {
+	if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(mountpoint, mode); err != nil {
+		return fmt.Errorf("creating mountpoint: %v", err)
+	}
+	return nil
+}
+
+// isMounted reports whether a FUSE filesystem is mounted on dir, which is
+// so if it's on a different device from its parent and on a FUSE
+// filesystem, or is a FUSE mount whose server has gone away so that it
+// can't even be stat'd.
+func isMounted(dir string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		if errors.Is(err, syscall.ENOTCONN) {
+			return true, nil
+		}
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("mountpoint: %v", err)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	if abs != "/" {
+		if err := syscall.Stat(filepath.Dir(abs), &parent); err != nil {
+			return false, fmt.Errorf("mountpoint: %v", err)
+		}
+		if st.Dev == parent.Dev {
+			return false, nil
+		}
+	}
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &sfs); err != nil {
+		if errors.Is(err, syscall.ENOTCONN) {
+			return true, nil
+		}
+		return false, fmt.Errorf("mountpoint: %v", err)
+	}
+	return isFuse(&sfs), nil
+}
+
+// lazyUnmount detaches whatever is mounted on dir, even if it's busy.
+func lazyUnmount(dir string) error {
+	cmd := exec.Command("umount", "-f", dir)
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("fusermount", "-u", "-z", dir)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// isFuse reports whether sfs describes a FUSE filesystem, which is named
+// fusefs on FreeBSD, and osxfuse or macfuse on macOS.
+func isFuse(sfs *syscall.Statfs_t) bool {
+	b := make([]byte, 0, len(sfs.Fstypename))
+	for _, c := range sfs.Fstypename {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return strings.Contains(string(b), "fuse")
+}
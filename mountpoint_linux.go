@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+// fuseSuperMagic is the f_type statfs reports for FUSE filesystems.
+const fuseSuperMagic = 0x65735546
+
+// isFuse reports whether sfs describes a FUSE filesystem.
+func isFuse(sfs *syscall.Statfs_t) bool {
+	return sfs.Type == fuseSuperMagic
+}
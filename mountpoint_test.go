@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckMountpoint(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	full := filepath.Join(dir, "full")
+	file := filepath.Join(full, "file")
+	for _, d := range []string{empty, full} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		empty:                         "",
+		full:                          "not empty",
+		file:                          "not a directory",
+		filepath.Join(dir, "missing"): "no such file",
+	} {
+		err := checkMountpoint(path, false)
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%s: %v", path, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("%s: got %v, want an error saying %q", path, err, want)
+		}
+	}
+}
+
+// TestIsMountedNotFuse checks that mounts other than FUSE ones, such as
+// procfs and tmpfs, don't count, so that -force leaves them be.
+func TestIsMountedNotFuse(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs procfs")
+	}
+	for _, dir := range []string{"/proc", "/dev/shm"} {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if mounted, err := isMounted(dir); err != nil || mounted {
+			t.Errorf("%s: got %v, %v, want false", dir, mounted, err)
+		}
+	}
+}
+
+func TestMakeMountpoint(t *testing.T) {
+	dir := t.TempDir()
+	mnt := filepath.Join(dir, "a", "b")
+	if err := makeMountpoint(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMountpoint(mnt, false); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("created with mode %v", fi.Mode())
+	}
+
+	// An existing directory is left alone, contents and all.
+	file := filepath.Join(mnt, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeMountpoint(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// encodeName returns the filename presenting the Vault key name.  Keys may
+// contain characters that can't appear in a filename, so those are
+// percent-encoded, along with the percent sign itself.
+func encodeName(name string) string {
+	if !strings.ContainsAny(name, "%/\x00") {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '%', '/', 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// newName returns the Vault key for name, the filename given to a new
+// entry, which must be a single path component.
+func newName(name string) (string, error) {
+	key, err := decodeName(name)
+	if err != nil || key == "" || strings.Contains(key, "/") {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return key, nil
+}
+
+// decodeName returns the Vault key presented as the filename name.  It
+// fails for names that encodeName can't have produced.
+func decodeName(name string) (string, error) {
+	if !strings.Contains(name, "%") {
+		return name, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("invalid escape in %q", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// foldName returns the key among keys, the result of a list, that name
+// refers to when looking up case-insensitively: name itself if it's there,
+// else the one key equal to it but for case.  Where several keys differ
+// from name only by case, there's no telling which was meant, so name is
+// returned as is and the ambiguity is logged.  Without CaseInsensitive
+// name is always returned as is.
+func (f *FS) foldName(name string, keys []string) string {
+	if !f.cfg.CaseInsensitive {
+		return name
+	}
+	var matches []string
+	for _, key := range keys {
+		key = strings.TrimSuffix(key, "/")
+		if key == name {
+			return name
+		}
+		if strings.EqualFold(key, name) && (len(matches) == 0 || matches[len(matches)-1] != key) {
+			matches = append(matches, key)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return name
+	case 1:
+		return matches[0]
+	}
+	f.cfg.Logger.Warn("several keys differ from name only by case; can't tell which is meant", "name", name, "keys", matches)
+	return name
+}
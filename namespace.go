@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// listNamespaces returns the names of the child namespaces of f's
+// namespace.  On Vault OSS, which has no namespaces, the list is empty.
+func (f *FS) listNamespaces(ctx context.Context) ([]string, error) {
+	ss, err := list(ctx, f.client, "sys/namespaces")
+	switch err {
+	case nil:
+	case fuse.ENOENT, fuse.Errno(syscall.EACCES):
+		return nil, nil
+	default:
+		return nil, err
+	}
+	names := make([]string, 0, len(ss))
+	for _, s := range ss {
+		names = append(names, strings.TrimSuffix(s, "/"))
+	}
+	return names, nil
+}
+
+// namespaceFS returns the FS for the child namespace name.  Each has its
+// own client and caches, so that operations in sibling namespaces don't
+// interfere; it's created on first use and reused thereafter.  name may be
+// a path of nested namespaces.
+func (f *FS) namespaceFS(name string) (*FS, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if child, ok := f.namespaces[name]; ok {
+		return child, nil
+	}
+
+	client, err := f.client.Clone()
+	if err != nil {
+		return nil, err
+	}
+	// Clone only copies the config, so carry over the token and headers.
+	client.SetToken(f.client.Token())
+	client.SetHeaders(f.client.Headers())
+	cfg := f.cfg
+	cfg.Namespace = path.Join(f.cfg.Namespace, name)
+	// Mounts are mapped to namespaces only from the one mounted.
+	cfg.MountNamespaces = nil
+	client.SetNamespace(cfg.Namespace)
+
+	child := newFS(&vaultapi{Client: client, logger: f.client.logger, failover: f.client.failover, seal: f.client.seal, inflight: f.client.inflight}, cfg)
+	child.nspath = path.Join(f.nspath, name)
+	child.disk = f.disk
+	child.issued = f.issued
+	f.namespaces[name] = child
+	return child, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makePkiNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &PkiDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// PkiDir presents a pki mount.  It holds the ca and crl files and a certs
+// directory with a file per issued certificate, named by serial number.
+type PkiDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+var _ fs.Node = (*PkiDir)(nil)
+
+func (d *PkiDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*PkiDir)(nil)
+
+func (d *PkiDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		d.fs.dirent("ca", fuse.DT_File, filepath.Join(d.mountpt, "cert", "ca")),
+		d.fs.dirent("certs", fuse.DT_Dir, filepath.Join(d.mountpt, "certs")),
+		d.fs.dirent("crl", fuse.DT_File, filepath.Join(d.mountpt, "cert", "crl")),
+	}, nil
+}
+
+var _ fs.NodeStringLookuper = (*PkiDir)(nil)
+
+func (d *PkiDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	switch name {
+	case "ca", "crl":
+		return d.cert(ctx, name)
+	case "certs":
+		return &PkiCertsDir{d}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// cert returns a file holding the PEM of the certificate with the given
+// serial, or of the ca or crl.
+func (d *PkiDir) cert(ctx context.Context, serial string) (fs.Node, error) {
+	path := filepath.Join(d.mountpt, "cert", serial)
+	sec, err := d.fs.client.Logical().Read(ctx, path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	pem, ok := secretString(sec, "certificate")
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return newFile(d.fs, path, []byte(pem)), nil
+}
+
+// PkiCertsDir lists the serial numbers of the certificates issued by a
+// pki mount.
+type PkiCertsDir struct {
+	*PkiDir
+}
+
+func (d *PkiCertsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, "certs"), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*PkiCertsDir)(nil)
+
+func (d *PkiCertsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, filepath.Join(d.mountpt, "certs"), filepath.Join(d.mountpt, "cert"))
+}
+
+var _ fs.NodeStringLookuper = (*PkiCertsDir)(nil)
+
+func (d *PkiCertsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return d.cert(ctx, name)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// watch records f to be polled for changes, if polling is enabled.
+func (f *FS) watch(file *File) {
+	if f.cfg.PollInterval <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watched[file] = true
+}
+
+var _ fs.NodeForgetter = (*File)(nil)
+
+// Forget stops polling f once the kernel has dropped it.
+func (f *File) Forget() {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	delete(f.fs.watched, f)
+}
+
+// invalidator is the part of fs.Server used to drop the kernel's caches.
+type invalidator interface {
+	InvalidateNodeData(node fs.Node) error
+}
+
+// pollChanges re-reads the watched files' secrets every interval until ctx
+// is done, invalidating the kernel's cache of those that changed.
+func (f *FS) pollChanges(ctx context.Context, inv invalidator, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.poll(ctx, inv)
+		}
+	}
+}
+
+func (f *FS) poll(ctx context.Context, inv invalidator) {
+	f.mu.Lock()
+	files := make([]*File, 0, len(f.watched))
+	for file := range f.watched {
+		files = append(files, file)
+	}
+	f.mu.Unlock()
+
+	for _, file := range files {
+		changed, err := file.refresh(ctx)
+		if err != nil {
+			f.cfg.Logger.Debug("poll failed", "path", filepath.Join(file.dir.mountpt, file.path), "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := inv.InvalidateNodeData(file); err != nil && err != fuse.ErrNotCached {
+			f.cfg.Logger.Warn("invalidating kernel cache failed", "path", filepath.Join(file.dir.mountpt, file.path), "error", err)
+		}
+	}
+}
+
+// refresh re-reads f's secret from Vault and reports whether its content
+// changed.  Files being written are left alone.
+func (f *File) refresh(ctx context.Context) (bool, error) {
+	d := f.dir
+	d.fs.secrets.delete(filepath.Join(d.mountpt, d.pathread(f.path)))
+	sec, err := readSecret(ctx, d, f.path)
+	if err != nil {
+		return false, err
+	}
+	content, rawKey, err := secretContent(d, sec)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buf != nil || bytes.Equal(content, f.data()) {
+		return false, nil
+	}
+	f.content.Store(content)
+	f.rawKey = rawKey
+	f.mtime = sec.mtime
+	return true, nil
+}
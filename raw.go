@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// RawDir presents the Vault paths under path as they are, for reaching
+// endpoints no node maker covers, like auth/token/lookup-self.  It's
+// found at the root under the reserved name "raw".
+//
+// Reads may have side effects, such as issuing credentials, so what's a
+// directory and what's a file is told with LIST alone.  The prefixes of
+// mounts, including auth mounts under auth, are directories, and what
+// LIST of the parent shows is as shown.  Otherwise a path is a file if
+// Vault says it doesn't support LIST, as it does for endpoints such as
+// auth/token/lookup-self, and a directory if not, since Vault can't tell
+// a prefix of other paths from nothing at all.  Files hold the data of a
+// read of their path, made afresh each time they're opened and not
+// before.  Mounts that MountAllow and MountDeny keep from the root are
+// kept from here too, along with everything under them.
+type RawDir struct {
+	fs   *FS
+	path string
+	// mounts holds the paths of the mounts, with trailing slashes, as of
+	// the lookup of the raw root.
+	mounts []string
+	dirNode
+}
+
+func rawDir(d *RootDir) fs.Node {
+	return &RawDir{fs: d.fs}
+}
+
+// rawPath returns the path from which the inode number of the raw node
+// at p is derived, distinct from that of the node presenting p elsewhere.
+func rawPath(p string) string {
+	return p + "\x00raw"
+}
+
+// refused reports whether a request failing with err was refused, as
+// opposed to Vault being unable to answer, so that asking something else
+// may get further.
+func refused(err error) bool {
+	if err == fuse.Errno(syscall.EACCES) || err == fuse.ENOENT {
+		return true
+	}
+	rerr, ok := err.(*responseError)
+	return ok && rerr.StatusCode < 500
+}
+
+// mountPaths returns the paths of the secret engine and auth mounts, so
+// far as the token may read them.
+func (d *RawDir) mountPaths(ctx context.Context) ([]string, error) {
+	if d.path != "" {
+		return d.mounts, nil
+	}
+	var paths []string
+	mounts, err := d.fs.client.Logical().ListMounts(ctx)
+	if err != nil && !refused(err) {
+		return nil, errno(err)
+	}
+	for p := range mounts {
+		paths = append(paths, p)
+	}
+	auths, err := d.fs.client.Logical().Read(ctx, "sys/auth")
+	if err != nil && !refused(err) {
+		return nil, errno(err)
+	}
+	if auths != nil {
+		for p := range auths.Data {
+			paths = append(paths, "auth/"+p)
+		}
+	}
+	return paths, nil
+}
+
+// denied reports whether p is a mount, or under a mount, that the
+// MountAllow and MountDeny filters keep out.  Those filters are of secret
+// engines, so auth mounts aren't subject to them.
+func (d *RawDir) denied(mounts []string, p string) bool {
+	for _, m := range mounts {
+		if !strings.HasPrefix(m, "auth/") && strings.HasPrefix(p+"/", m) && !d.fs.mountAllowed(strings.TrimSuffix(m, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe returns the keys LIST shows under p, and whether Vault said p
+// doesn't support LIST.  Other refusals count as there being no keys.
+func (d *RawDir) probe(ctx context.Context, p string) ([]string, bool, error) {
+	if p == "" {
+		return nil, false, nil
+	}
+	ss, err := list(ctx, d.fs.client, p)
+	if rerr, ok := err.(*responseError); ok && rerr.StatusCode == http.StatusMethodNotAllowed {
+		return nil, true, nil
+	}
+	if err != nil && !refused(err) {
+		return nil, false, err
+	}
+	return ss, false, nil
+}
+
+var _ fs.Node = (*RawDir)(nil)
+
+func (d *RawDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, rawPath(d.path), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*RawDir)(nil)
+
+func (d *RawDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	mounts, err := d.mountPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ss []string
+	if d.path != "" {
+		ss, err = list(ctx, d.fs.client, d.path)
+		if rerr, ok := err.(*responseError); ok && rerr.StatusCode == http.StatusMethodNotAllowed {
+			// Not every prefix supports LIST.
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Entries leading to mounts are directories, whatever's listed.
+	prefix := d.path + "/"
+	if d.path == "" {
+		prefix = ""
+	}
+	entries := make(map[string]bool)
+	for _, m := range mounts {
+		if !strings.HasPrefix(m, prefix) || d.denied(mounts, strings.TrimSuffix(m, "/")) {
+			continue
+		}
+		rest := m[len(prefix):]
+		if i := strings.Index(rest, "/"); i > 0 {
+			entries[rest[:i]] = true
+		}
+	}
+	for _, s := range ss {
+		name := strings.TrimSuffix(s, "/")
+		if !d.denied(mounts, path.Join(d.path, name)) {
+			entries[name] = entries[name] || name != s
+		}
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dirs := make([]fuse.Dirent, len(names))
+	for i, name := range names {
+		dtype, dir := fuse.DT_File, entries[name]
+		if dir {
+			dtype = fuse.DT_Dir
+		}
+		dirs[i] = fuse.Dirent{Name: encodeName(name), Type: dtype}
+		dirs[i].Inode = d.fs.inode(rawPath(path.Join(d.path, name)), dir)
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*RawDir)(nil)
+
+func (d *RawDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	name, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	p := path.Join(d.path, name)
+	mounts, err := d.mountPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d.denied(mounts, p) {
+		return nil, fuse.ENOENT
+	}
+	dir := &RawDir{fs: d.fs, path: p, mounts: mounts}
+	for _, m := range mounts {
+		if strings.HasPrefix(m, p+"/") && !d.denied(mounts, strings.TrimSuffix(m, "/")) {
+			return dir, nil
+		}
+	}
+	ss, _, err := d.probe(ctx, d.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		switch s {
+		case name + "/":
+			return dir, nil
+		case name:
+			return d.file(p), nil
+		}
+	}
+	_, unlistable, err := d.probe(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if unlistable {
+		return d.file(p), nil
+	}
+	return dir, nil
+}
+
+// file returns the file holding the data read from p.
+func (d *RawDir) file(p string) fs.Node {
+	return &liveFile{
+		fs:   d.fs,
+		path: rawPath(p),
+		fetch: func(ctx context.Context) ([]byte, error) {
+			sec, err := d.fs.client.Logical().Read(ctx, p)
+			if err != nil {
+				return nil, errno(err)
+			}
+			if sec == nil {
+				return nil, fuse.ENOENT
+			}
+			return d.fs.marshal(sec.Data)
+		},
+		unsized: true,
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makeSshNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &SshDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// SshDir presents an ssh mount.  It holds a sign directory with a file per
+// role: writing a public key to it has the key signed, after which the
+// certificate can be read back.  Like issuing credentials, signing leaves
+// Vault's secrets as they were, so it's allowed read-only.
+type SshDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+var _ fs.Node = (*SshDir)(nil)
+
+func (d *SshDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SshDir)(nil)
+
+func (d *SshDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{d.fs.dirent("sign", fuse.DT_Dir, filepath.Join(d.mountpt, "sign"))}, nil
+}
+
+var _ fs.NodeStringLookuper = (*SshDir)(nil)
+
+func (d *SshDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "sign" {
+		return &SshSignDir{d}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// SshSignDir lists the roles of an ssh mount.
+type SshSignDir struct {
+	*SshDir
+}
+
+func (d *SshSignDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, "sign"), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SshSignDir)(nil)
+
+func (d *SshSignDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, filepath.Join(d.mountpt, "roles"), filepath.Join(d.mountpt, "sign"))
+}
+
+var _ fs.NodeStringLookuper = (*SshSignDir)(nil)
+
+func (d *SshSignDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	role, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	roles, err := d.fs.cachedList(ctx, filepath.Join(d.mountpt, "roles"))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		if r == role {
+			path := filepath.Join(d.mountpt, "sign", role)
+			return d.fs.opFile(path, func(ctx context.Context, in []byte) ([]byte, error) {
+				return d.sign(ctx, path, in)
+			}), nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// sign has the public key in pub signed at path, returning the
+// certificate.  Signing stores nothing in Vault, so it's a computation
+// like transit's, made even in a dry run.
+func (d *SshSignDir) sign(ctx context.Context, path string, pub []byte) ([]byte, error) {
+	sec, err := d.fs.client.Logical().Compute(ctx, path, map[string]interface{}{
+		"public_key": string(pub),
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	cert, ok := secretString(sec, "signed_key")
+	if !ok {
+		return nil, fmt.Errorf("no signed_key in sign response")
+	}
+	return []byte(cert), nil
+}
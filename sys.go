@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"sort"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makeSysNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &SysDir{fs: f, mountpt: mountpt}, nil
+}
+
+// SysDir presents a read-only selection of sys/ endpoints as JSON files,
+// along with a policies directory.
+type SysDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+// sysFiles maps the files in SysDir to the functions fetching their
+// content.
+var sysFiles = map[string]func(context.Context, *FS) (interface{}, error){
+	"health":      sysHealth,
+	"mounts":      sysMounts,
+	"seal-status": sysSealStatus,
+}
+
+var _ fs.Node = (*SysDir)(nil)
+
+func (d *SysDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SysDir)(nil)
+
+func (d *SysDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirs := make([]fuse.Dirent, 0, len(sysFiles)+1)
+	for name := range sysFiles {
+		dirs = append(dirs, d.fs.dirent(name, fuse.DT_File, path.Join(d.mountpt, name)))
+	}
+	dirs = append(dirs, d.fs.dirent("policies", fuse.DT_Dir, path.Join(d.mountpt, "policies")))
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Name < dirs[j].Name
+	})
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*SysDir)(nil)
+
+func (d *SysDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "policies" {
+		return &SysPoliciesDir{d}, nil
+	}
+	get, ok := sysFiles[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return &liveFile{
+		fs:   d.fs,
+		path: path.Join(d.mountpt, name),
+		fetch: func(ctx context.Context) ([]byte, error) {
+			v, err := get(ctx, d.fs)
+			if err != nil {
+				return nil, errno(err)
+			}
+			return d.fs.marshal(v)
+		},
+	}, nil
+}
+
+func sysHealth(ctx context.Context, f *FS) (interface{}, error) {
+	// As in api.Sys.Health, have Vault report success whatever its
+	// state, so that the state can be shown.
+	params := url.Values{}
+	for _, p := range []string{"uninitcode", "sealedcode", "standbycode", "drsecondarycode", "performancestandbycode"} {
+		params.Set(p, "299")
+	}
+	var health api.HealthResponse
+	err := f.client.Logical().ReadJSON(ctx, "sys/health", params, &health)
+	return health, err
+}
+
+func sysSealStatus(ctx context.Context, f *FS) (interface{}, error) {
+	var status api.SealStatusResponse
+	err := f.client.Logical().ReadJSON(ctx, "sys/seal-status", nil, &status)
+	return status, err
+}
+
+func sysMounts(ctx context.Context, f *FS) (interface{}, error) {
+	sec, err := f.client.Logical().Read(ctx, "sys/mounts")
+	if err != nil {
+		return nil, err
+	}
+	if sec == nil {
+		return nil, fuse.ENOENT
+	}
+	return sec.Data, nil
+}
+
+// SysPoliciesDir holds an acl directory of the ACL policies.
+type SysPoliciesDir struct {
+	*SysDir
+}
+
+func (d *SysPoliciesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, path.Join(d.mountpt, "policies"), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SysPoliciesDir)(nil)
+
+func (d *SysPoliciesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{{Name: "acl", Type: fuse.DT_Dir}}, nil
+}
+
+var _ fs.NodeStringLookuper = (*SysPoliciesDir)(nil)
+
+func (d *SysPoliciesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "acl" {
+		return &SysACLDir{d.SysDir}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// SysACLDir lists the ACL policies, each a file of its HCL.
+type SysACLDir struct {
+	*SysDir
+}
+
+// path returns the Vault path of the directory.
+func (d *SysACLDir) path() string {
+	return path.Join(d.mountpt, "policies", "acl")
+}
+
+func (d *SysACLDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.path(), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*SysACLDir)(nil)
+
+func (d *SysACLDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, d.path(), d.path())
+}
+
+var _ fs.NodeStringLookuper = (*SysACLDir)(nil)
+
+// Lookup returns a liveFile, so that policy changes show without waiting
+// for the kernel to forget the file.
+func (d *SysACLDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	policy, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	vpath := path.Join(d.path(), policy)
+	fetch := func(ctx context.Context) ([]byte, error) {
+		sec, err := d.fs.client.Logical().Read(ctx, vpath)
+		if err != nil {
+			return nil, errno(err)
+		}
+		hcl, ok := secretString(sec, "policy")
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		return []byte(hcl), nil
+	}
+	if _, err := fetch(ctx); err != nil {
+		return nil, err
+	}
+	return &liveFile{fs: d.fs, path: vpath, fetch: fetch}, nil
+}
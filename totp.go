@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makeTotpNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &TotpDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// TotpDir presents a totp mount.  It holds a code directory with a file
+// per key, holding its current code.
+type TotpDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+var _ fs.Node = (*TotpDir)(nil)
+
+func (d *TotpDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*TotpDir)(nil)
+
+func (d *TotpDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{d.fs.dirent("code", fuse.DT_Dir, filepath.Join(d.mountpt, "code"))}, nil
+}
+
+var _ fs.NodeStringLookuper = (*TotpDir)(nil)
+
+func (d *TotpDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "code" {
+		return &TotpCodeDir{d}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// TotpCodeDir lists the keys of a totp mount.
+type TotpCodeDir struct {
+	*TotpDir
+}
+
+func (d *TotpCodeDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, "code"), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*TotpCodeDir)(nil)
+
+func (d *TotpCodeDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return listDirents(ctx, d.fs, filepath.Join(d.mountpt, "keys"), filepath.Join(d.mountpt, "code"))
+}
+
+var _ fs.NodeStringLookuper = (*TotpCodeDir)(nil)
+
+// Lookup returns a liveFile, since codes rotate every period and so must
+// never be served from a cache.
+func (d *TotpCodeDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	path := filepath.Join(d.mountpt, "code", key)
+	fetch := func(ctx context.Context) ([]byte, error) {
+		sec, err := d.fs.client.Logical().Read(ctx, path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		code, ok := secretString(sec, "code")
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		return []byte(code), nil
+	}
+	if _, err := fetch(ctx); err != nil {
+		return nil, err
+	}
+	return &liveFile{fs: d.fs, path: path, fetch: fetch}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/hashicorp/vault/api"
+)
+
+func makeTransitNode(f *FS, mountpt string, mount *api.MountOutput) (fs.Node, error) {
+	return &TransitDir{
+		fs:      f,
+		mountpt: mountpt,
+	}, nil
+}
+
+// TransitDir presents a transit mount as a directory per key.
+type TransitDir struct {
+	fs      *FS
+	mountpt string
+	dirNode
+}
+
+var _ fs.Node = (*TransitDir)(nil)
+
+func (d *TransitDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, d.mountpt, 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*TransitDir)(nil)
+
+func (d *TransitDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	keys := filepath.Join(d.mountpt, "keys")
+	dirs, err := listDirents(ctx, d.fs, keys, keys)
+	if err != nil {
+		return nil, err
+	}
+	// Keys are listed like secrets, but presented as directories.
+	for i, dirent := range dirs {
+		key, _ := decodeName(dirent.Name)
+		dirs[i] = d.fs.dirent(dirent.Name, fuse.DT_Dir, filepath.Join(keys, key))
+	}
+	return dirs, nil
+}
+
+var _ fs.NodeStringLookuper = (*TransitDir)(nil)
+
+func (d *TransitDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key, err := decodeName(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	keys, err := d.fs.cachedList(ctx, filepath.Join(d.mountpt, "keys"))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k == key {
+			return &TransitKeyDir{
+				TransitDir: d,
+				key:        key,
+			}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// TransitKeyDir holds the encrypt and decrypt files for a transit key.
+// Writing plaintext to encrypt makes the ciphertext readable from it, and
+// writing ciphertext to decrypt makes the plaintext readable from it.
+type TransitKeyDir struct {
+	*TransitDir
+	key string
+}
+
+func (d *TransitKeyDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.dirAttr(a, filepath.Join(d.mountpt, "keys", d.key), 0555)
+	return nil
+}
+
+var _ fs.HandleReadDirAller = (*TransitKeyDir)(nil)
+
+func (d *TransitKeyDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		d.fs.dirent("decrypt", fuse.DT_File, filepath.Join(d.mountpt, "decrypt", d.key)),
+		d.fs.dirent("encrypt", fuse.DT_File, filepath.Join(d.mountpt, "encrypt", d.key)),
+	}, nil
+}
+
+var _ fs.NodeStringLookuper = (*TransitKeyDir)(nil)
+
+func (d *TransitKeyDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	var op opFunc
+	switch name {
+	case "encrypt":
+		op = d.encrypt
+	case "decrypt":
+		op = d.decrypt
+	default:
+		return nil, fuse.ENOENT
+	}
+	path := filepath.Join(d.mountpt, name, d.key)
+	return d.fs.opFile(path, op), nil
+}
+
+func (d *TransitKeyDir) encrypt(ctx context.Context, in []byte) ([]byte, error) {
+	sec, err := d.fs.client.Logical().Compute(ctx, filepath.Join(d.mountpt, "encrypt", d.key), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(in),
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	ct, ok := secretString(sec, "ciphertext")
+	if !ok {
+		return nil, fmt.Errorf("no ciphertext in encrypt response")
+	}
+	return []byte(ct), nil
+}
+
+func (d *TransitKeyDir) decrypt(ctx context.Context, in []byte) ([]byte, error) {
+	sec, err := d.fs.client.Logical().Compute(ctx, filepath.Join(d.mountpt, "decrypt", d.key), map[string]interface{}{
+		"ciphertext": string(bytes.TrimSpace(in)),
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	pt, ok := secretString(sec, "plaintext")
+	if !ok {
+		return nil, fmt.Errorf("no plaintext in decrypt response")
+	}
+	return base64.StdEncoding.DecodeString(pt)
+}
+
+// secretString returns the string value of key in sec's data.
+func secretString(sec *api.Secret, key string) (string, bool) {
+	if sec == nil {
+		return "", false
+	}
+	s, ok := sec.Data[key].(string)
+	return s, ok
+}
@@ -1,61 +1,439 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"bazil.org/fuse"
 	"github.com/hashicorp/vault/api"
 )
 
 type vaultapi struct {
 	*api.Client
+	// logger receives a debug record for each call; nil means
+	// slog.Default().
+	logger *slog.Logger
+	// retries is how many times to retry transient failures.
+	retries int
+	// timeout, if non-zero, bounds each call including its retries.
+	timeout time.Duration
+	// failover, if set, picks the address of each request.
+	failover *failover
+	// seal, if set, tracks whether Vault is sealed.
+	seal *sealWatch
+	// inflight, if set, holds a token for each request in progress, its
+	// capacity limiting how many there can be.
+	inflight chan struct{}
+	// dryRun logs writes and deletes instead of performing them.
+	dryRun bool
 }
 
 func (v vaultapi) Logical() *vaultlog {
-	return &vaultlog{v.Client.Logical()}
+	logger := v.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &vaultlog{
+		Logical:  v.Client.Logical(),
+		client:   v.Client,
+		logger:   logger,
+		retries:  v.retries,
+		timeout:  v.timeout,
+		failover: v.failover,
+		seal:     v.seal,
+		inflight: v.inflight,
+		dryRun:   v.dryRun,
+	}
 }
 
 type vaultlog struct {
 	*api.Logical
+	client   *api.Client
+	logger   *slog.Logger
+	retries  int
+	timeout  time.Duration
+	failover *failover
+	seal     *sealWatch
+	inflight chan struct{}
+	dryRun   bool
+}
+
+// Retries wait retryDelay after the first failure, doubling each time up
+// to maxRetryDelay.
+var (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+)
+
+// retryable reports whether a request that failed with err and status,
+// zero if there was no response, might succeed if retried.
+func retryable(status int, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return status == 0 || status >= 500
+}
+
+// sealWatch tracks whether Vault is sealed, as seen from the responses to
+// our requests, so that the change can be logged once rather than with
+// every failing request.  It's shared by the clients of all namespaces.
+type sealWatch struct {
+	mu     sync.Mutex
+	sealed bool
+}
+
+// observe records the outcome of a request, logging any change in seal
+// state, and reports whether it failed because Vault is sealed, which
+// errno turns into EAGAIN.  A nil sealWatch observes nothing.
+func (w *sealWatch) observe(logger *slog.Logger, status int, err error) bool {
+	if w == nil {
+		return false
+	}
+	sealed := status == http.StatusServiceUnavailable && err != nil && strings.Contains(err.Error(), "Vault is sealed")
+	if !sealed && status == 0 {
+		// No response, so no news about the seal.
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if sealed != w.sealed {
+		if sealed {
+			logger.Warn("Vault is sealed; requests fail with EAGAIN until it's unsealed")
+		} else {
+			logger.Info("Vault is unsealed")
+		}
+		w.sealed = sealed
+	}
+	return sealed
+}
+
+// responseError is returned for Vault responses with an error status.
+type responseError struct {
+	StatusCode int
+	err        error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+// errno maps Vault response errors whose status has a natural POSIX
+// equivalent to the corresponding errno, and returns other errors as-is.
+// Calls cut short by their context yield EINTR if the operation was
+// interrupted, or EAGAIN if it timed out.
+func errno(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return fuse.Errno(syscall.EINTR)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	rerr, ok := err.(*responseError)
+	if !ok {
+		return err
+	}
+	switch rerr.StatusCode {
+	case http.StatusForbidden:
+		return fuse.Errno(syscall.EACCES)
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusServiceUnavailable:
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return err
+}
+
+// do performs r and parses the resulting secret, logging the call as op.
+// As with api.Logical, a 404 without data or warnings yields a nil secret
+// and error.  Other error responses yield a *responseError.  Transient
+// failures are retried up to c.retries times, with exponential backoff.
+func (c *vaultlog) do(ctx context.Context, op, path string, r *api.Request) (*api.Secret, error) {
+	var sec *api.Secret
+	err := c.retry(ctx, op, path, func(ctx context.Context) (int, error) {
+		var status int
+		var err error
+		sec, status, err = c.doRequest(ctx, r)
+		return status, err
+	})
+	return sec, err
+}
+
+// retry calls attempt, which returns the response status or zero if there
+// was none, until it succeeds, fails permanently or runs out of retries.
+// Each attempt is logged and counted as op.
+func (c *vaultlog) retry(ctx context.Context, op, path string, attempt func(context.Context) (int, error)) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	delay := retryDelay
+	for i := 0; ; i++ {
+		if err := c.acquire(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		status, err := attempt(ctx)
+		c.release()
+		vaultMetrics.observe(op, status, time.Since(start))
+		c.log(ctx, op, path, start, err)
+		// Unsealing takes an operator, so it's not worth retrying for.
+		if c.seal.observe(c.logger, status, err) {
+			return err
+		}
+		if err == nil || i >= c.retries || !retryable(status, err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// acquire waits until fewer than the maximum number of requests are in
+// progress, or ctx is done.  Each successful call must be followed by one
+// to release once the request is done with.
+func (c *vaultlog) acquire(ctx context.Context) error {
+	if c.inflight == nil {
+		return nil
+	}
+	select {
+	case c.inflight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errno(ctx.Err())
+	}
+}
+
+func (c *vaultlog) release() {
+	if c.inflight != nil {
+		<-c.inflight
+	}
 }
 
-func (c *vaultlog) Delete(path string) (*api.Secret, error) {
-	if debug {
-		log.Printf("Delete(%s)\n", path)
+// log records a call to Vault at debug level.
+func (c *vaultlog) log(ctx context.Context, op, path string, start time.Time, err error) {
+	attrs := []slog.Attr{
+		slog.String("path", path),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
 	}
-	return c.Logical.Delete(path)
+	c.logger.LogAttrs(ctx, slog.LevelDebug, op, attrs...)
+}
 
+// doRequest performs r, returning the secret and the response status, or
+// zero if there was no response.
+func (c *vaultlog) doRequest(ctx context.Context, r *api.Request) (*api.Secret, int, error) {
+	resp, err := c.send(ctx, r)
+	if resp == nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		secret, parseErr := api.ParseSecret(resp.Body)
+		switch parseErr {
+		case nil:
+		case io.EOF:
+			return nil, resp.StatusCode, nil
+		default:
+			return nil, resp.StatusCode, err
+		}
+		if secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0) {
+			return secret, resp.StatusCode, nil
+		}
+		return nil, resp.StatusCode, nil
+	}
+	if err != nil {
+		return nil, resp.StatusCode, &responseError{StatusCode: resp.StatusCode, err: err}
+	}
+	sec, err := api.ParseSecret(resp.Body)
+	return sec, resp.StatusCode, err
 }
-func (c *vaultlog) List(path string) (*api.Secret, error) {
-	if debug {
-		log.Printf("List(%s)\n", path)
+
+// send performs r, directing it to the current address if failing over
+// between several.  A failure that would be retried moves on to the next
+// address, and a redirect from a standby to the active node is followed
+// by later requests too.
+func (c *vaultlog) send(ctx context.Context, r *api.Request) (*api.Response, error) {
+	addr := c.failover.target(r)
+	resp, err := c.client.RawRequestWithContext(ctx, r)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
 	}
-	return c.Logical.List(path)
+	switch {
+	case ctx.Err() != nil:
+	case retryable(status, err):
+		c.failover.failed(c.client, addr)
+	case r.URL.Host != addr.Host:
+		c.failover.redirected(c.client, addr, r.URL)
+	}
+	return resp, err
+}
 
+// skip reports whether the modification op of path with data is to be
+// skipped for a dry run, logging it if so.  Only the names of the fields
+// written are logged, not their values.
+func (c *vaultlog) skip(ctx context.Context, op, path string, data map[string]interface{}) bool {
+	if !c.dryRun {
+		return false
+	}
+	fields := make([]string, 0, len(data))
+	for k := range data {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	c.logger.LogAttrs(ctx, slog.LevelInfo, "dry run",
+		slog.String("op", op),
+		slog.String("path", path),
+		slog.Any("fields", fields))
+	return true
 }
-func (c *vaultlog) Read(path string) (*api.Secret, error) {
-	if debug {
-		log.Printf("Read(%s)\n", path)
+
+func (c *vaultlog) Delete(ctx context.Context, path string) (*api.Secret, error) {
+	if c.skip(ctx, "Delete", path, nil) {
+		return nil, nil
 	}
-	return c.Logical.Read(path)
+	r := c.client.NewRequest("DELETE", "/v1/"+path)
+	return c.do(ctx, "Delete", path, r)
+}
 
+func (c *vaultlog) List(ctx context.Context, path string) (*api.Secret, error) {
+	r := c.client.NewRequest("LIST", "/v1/"+path)
+	// As in api.Logical, use GET with a list parameter for compatibility.
+	r.Method = "GET"
+	r.Params.Set("list", "true")
+	return c.do(ctx, "List", path, r)
 }
-func (c *vaultlog) ReadWithData(path string, data map[string][]string) (*api.Secret, error) {
-	if debug {
-		log.Printf("Write(%s, %v)\n", path, data)
+
+// ListMounts is like api.Sys.ListMounts, but can be cancelled through
+// ctx, and is retried and logged like any other call.
+func (c *vaultlog) ListMounts(ctx context.Context) (map[string]*api.MountOutput, error) {
+	sec, err := c.Read(ctx, "sys/mounts")
+	if err != nil {
+		return nil, err
 	}
-	return c.Logical.ReadWithData(path, data)
+	if sec == nil || sec.Data == nil {
+		return nil, errors.New("data from server response is empty")
+	}
+	// MountOutput has JSON tags but no mapstructure ones, so convert via
+	// JSON rather than as api.Sys does.
+	b, err := json.Marshal(sec.Data)
+	if err != nil {
+		return nil, err
+	}
+	mounts := map[string]*api.MountOutput{}
+	if err := json.Unmarshal(b, &mounts); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
 
+func (c *vaultlog) Read(ctx context.Context, path string) (*api.Secret, error) {
+	r := c.client.NewRequest("GET", "/v1/"+path)
+	return c.do(ctx, "Read", path, r)
 }
-func (c *vaultlog) Unwrap(wrappingToken string) (*api.Secret, error) {
-	if debug {
-		log.Printf("Unwrap(%s)\n", wrappingToken)
+
+func (c *vaultlog) ReadWithData(ctx context.Context, path string, data map[string][]string) (*api.Secret, error) {
+	r := c.client.NewRequest("GET", "/v1/"+path)
+	for k, vs := range data {
+		for _, v := range vs {
+			r.Params.Add(k, v)
+		}
 	}
-	return c.Logical.Unwrap(wrappingToken)
+	return c.do(ctx, "ReadWithData", path, r)
+}
 
+// ReadJSON reads path, whose response needn't be a secret, decoding the
+// response body into v.
+func (c *vaultlog) ReadJSON(ctx context.Context, path string, params url.Values, v interface{}) error {
+	r := c.client.NewRequest("GET", "/v1/"+path)
+	for k, vs := range params {
+		for _, p := range vs {
+			r.Params.Add(k, p)
+		}
+	}
+	return c.retry(ctx, "ReadJSON", path, func(ctx context.Context) (int, error) {
+		resp, err := c.send(ctx, r)
+		if resp == nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if err != nil {
+			return resp.StatusCode, &responseError{StatusCode: resp.StatusCode, err: err}
+		}
+		return resp.StatusCode, resp.DecodeJSON(v)
+	})
 }
-func (c *vaultlog) Write(path string, data map[string]interface{}) (*api.Secret, error) {
-	if debug {
-		log.Printf("Write(%s, %v)\n", path, data)
+
+// Unwrap returns the response wrapped by wrappingToken.  Unlike
+// api.Logical.Unwrap, it never changes the client's token.
+func (c *vaultlog) Unwrap(ctx context.Context, wrappingToken string) (*api.Secret, error) {
+	r := c.client.NewRequest("PUT", "/v1/sys/wrapping/unwrap")
+	if wrappingToken != c.client.Token() {
+		if err := r.SetJSONBody(map[string]interface{}{"token": wrappingToken}); err != nil {
+			return nil, err
+		}
+	}
+	return c.do(ctx, "Unwrap", "sys/wrapping/unwrap", r)
+}
+
+// ReadWrapped reads path, having Vault wrap the response in a token valid
+// for ttl.  The token is in the WrapInfo of the secret returned.
+func (c *vaultlog) ReadWrapped(ctx context.Context, path string, ttl time.Duration) (*api.Secret, error) {
+	r := c.client.NewRequest("GET", "/v1/"+path)
+	r.WrapTTL = strconv.Itoa(int(ttl/time.Second)) + "s"
+	return c.do(ctx, "ReadWrapped", path, r)
+}
+
+// Patch applies data to path as a JSON merge patch (RFC 7386).
+func (c *vaultlog) Patch(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	if c.skip(ctx, "Patch", path, data) {
+		return nil, nil
+	}
+	r := c.client.NewRequest("PATCH", "/v1/"+path)
+	if r.Headers == nil {
+		r.Headers = http.Header{}
+	}
+	r.Headers.Set("Content-Type", "application/merge-patch+json")
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	return c.do(ctx, "Patch", path, r)
+}
+
+func (c *vaultlog) Write(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	if c.skip(ctx, "Write", path, data) {
+		return nil, nil
+	}
+	return c.Compute(ctx, path, data)
+}
+
+// Compute is Write for endpoints that only compute a response from data,
+// such as transit's encrypt, leaving Vault as it was; it's performed even
+// in a dry run.
+func (c *vaultlog) Compute(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	r := c.client.NewRequest("PUT", "/v1/"+path)
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
 	}
-	return c.Logical.Write(path, data)
+	return c.do(ctx, "Write", path, r)
 }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/vault/api"
+)
+
+// stubvault returns a client talking to an HTTP server that answers
+// requests using handler, and a func to shut the server down.
+func stubvault(t *testing.T, handler http.HandlerFunc) (*vaultapi, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	client.SetToken("stub")
+	return &vaultapi{Client: client}, srv.Close
+}
+
+func TestErrno(t *testing.T) {
+	codes := map[string]int{
+		"/v1/forbidden": http.StatusForbidden,
+		"/v1/sealed":    http.StatusServiceUnavailable,
+		"/v1/broken":    http.StatusInternalServerError,
+	}
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(codes[r.URL.Path])
+		_, _ = w.Write([]byte(`{"errors":["stub"]}`))
+	})
+	defer cleanup()
+
+	for path, want := range map[string]error{
+		"forbidden": fuse.Errno(syscall.EACCES),
+		"sealed":    fuse.Errno(syscall.EAGAIN),
+	} {
+		_, err := list(context.Background(), client, path)
+		if err != want {
+			t.Errorf("%s: got %v, want %v", path, err, want)
+		}
+	}
+
+	_, err := list(context.Background(), client, "broken")
+	if _, ok := err.(*responseError); !ok {
+		t.Errorf("broken: got %T %v, want *responseError", err, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	var got string
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Vault-Namespace")
+	})
+	defer cleanup()
+
+	err := os.Setenv("VAULT_ADDR", client.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFS(Config{Namespace: "ns1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := list(context.Background(), f.client, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "ns1" {
+		t.Fatalf("X-Vault-Namespace=%q, want ns1", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer cleanup()
+
+	_, _ = client.Logical().Read(context.Background(), "metrics/test")
+
+	var buf bytes.Buffer
+	vaultMetrics.write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`fusevault_vault_requests_total{op="Read",status="403"} `,
+		`fusevault_vault_request_duration_seconds_bucket{op="Read",le="+Inf"} `,
+		`fusevault_vault_request_duration_seconds_count{op="Read"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestSealed(t *testing.T) {
+	var requests int
+	sealed := true
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if sealed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"errors":["Vault is sealed"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"a":"b"}}`))
+	})
+	defer cleanup()
+	var logs bytes.Buffer
+	client.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	client.retries = 2
+	client.seal = &sealWatch{}
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Logical().Read(context.Background(), "secret/foo")
+		if got := errno(err); got != fuse.Errno(syscall.EAGAIN) {
+			t.Errorf("got %v, want EAGAIN", got)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2: sealed requests shouldn't be retried", requests)
+	}
+	if n := strings.Count(logs.String(), "Vault is sealed"); n != 1 {
+		t.Errorf("logged sealing %d times, want once:\n%s", n, logs.String())
+	}
+
+	sealed = false
+	if _, err := client.Logical().Read(context.Background(), "secret/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Vault is unsealed") {
+		t.Errorf("unsealing not logged:\n%s", logs.String())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var methods []string
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		_, _ = w.Write([]byte(`{"data":{"ciphertext":"vault:v1:abc"}}`))
+	})
+	defer cleanup()
+	var logs bytes.Buffer
+	client.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	client.dryRun = true
+
+	ctx := context.Background()
+	if sec, err := client.Logical().Write(ctx, "secret/foo", map[string]interface{}{"b": "sekrit", "a": "x"}); sec != nil || err != nil {
+		t.Errorf("Write: got %v, %v, want nil, nil", sec, err)
+	}
+	if _, err := client.Logical().Patch(ctx, "secret/data/foo", map[string]interface{}{"a": "x"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.Logical().Delete(ctx, "secret/foo"); err != nil {
+		t.Error(err)
+	}
+	if len(methods) != 0 {
+		t.Errorf("dry run made requests: %v", methods)
+	}
+	if strings.Contains(logs.String(), "sekrit") {
+		t.Errorf("dry run logged a value:\n%s", logs.String())
+	}
+	var got []map[string]interface{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		delete(rec, "time")
+		delete(rec, "level")
+		got = append(got, rec)
+	}
+	want := []map[string]interface{}{
+		{"msg": "dry run", "op": "Write", "path": "secret/foo", "fields": []interface{}{"a", "b"}},
+		{"msg": "dry run", "op": "Patch", "path": "secret/data/foo", "fields": []interface{}{"a"}},
+		{"msg": "dry run", "op": "Delete", "path": "secret/foo", "fields": []interface{}{}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+
+	// Computations leave Vault as it was, so they're still made.
+	if _, err := client.Logical().Compute(ctx, "transit/encrypt/k", map[string]interface{}{"plaintext": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 1 {
+		t.Errorf("got %d requests for Compute, want 1", len(methods))
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const limit = 3
+	var mu sync.Mutex
+	var cur, max int
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cur++
+		if cur > max {
+			max = cur
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		cur--
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"data":{"a":"b"}}`))
+	})
+	defer cleanup()
+	client.inflight = make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Logical().Read(context.Background(), "secret/foo"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max != limit {
+		t.Errorf("got %d requests in progress at once, want %d", max, limit)
+	}
+
+	// A waiting request gives up when its context is done.
+	for i := 0; i < limit; i++ {
+		client.inflight <- struct{}{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.Logical().Read(ctx, "secret/foo"); err != fuse.Errno(syscall.EAGAIN) {
+		t.Errorf("got %v, want EAGAIN", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	var requests int
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/v1/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case requests <= 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte(`{"data":{"a":"b"}}`))
+		}
+	})
+	defer cleanup()
+	client.retries = 2
+
+	sec, err := client.Logical().Read(context.Background(), "secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.Data["a"] != "b" {
+		t.Errorf("got data %v", sec.Data)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	requests = 0
+	if _, err := client.Logical().Read(context.Background(), "forbidden"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests for a 403, want 1", requests)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	active := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"a":"b"}}`))
+	}))
+	defer active.Close()
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, active.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer standby.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer cleanup()
+	client.retries = 2
+	client.failover = newFailover([]string{down.URL, standby.URL})
+
+	sec, err := client.Logical().Read(context.Background(), "secret/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.Data["a"] != "b" {
+		t.Errorf("got data %v", sec.Data)
+	}
+	if got := client.Address(); got != active.URL {
+		t.Errorf("got address %s after redirect, want %s", got, active.URL)
+	}
+
+	// Once the active node goes away too, fail back over to the first.
+	active.Close()
+	if _, err := client.Logical().Read(context.Background(), "secret/foo"); err == nil {
+		t.Fatal("expected an error with every server down")
+	}
+	if got := client.Address(); got != down.URL {
+		t.Errorf("got address %s, want %s", got, down.URL)
+	}
+}
+
+func TestContext(t *testing.T) {
+	client, cleanup := stubvault(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer cleanup()
+	client.timeout = 10 * time.Millisecond
+
+	if _, err := list(context.Background(), client, "secret"); err != fuse.Errno(syscall.EAGAIN) {
+		t.Errorf("timed out: got %v, want EAGAIN", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := list(ctx, client, "secret"); err != fuse.Errno(syscall.EINTR) {
+		t.Errorf("interrupted: got %v, want EINTR", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"s.cert"}}`))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, pemCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{Config{Auth: "cert"}, true},
+		{Config{Auth: "cert", CACert: ca}, false},
+		{Config{Auth: "cert", TLSSkipVerify: true}, false},
+	} {
+		vcfg, err := apiConfig(tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vcfg.Address = srv.URL
+		vcfg.MaxRetries = 0
+		client, err := api.NewClient(vcfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = login(client, tc.cfg)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v", tc.cfg, err)
+		}
+		if err == nil && client.Token() != "s.cert" {
+			t.Errorf("got token %q", client.Token())
+		}
+	}
+
+	if _, err := apiConfig(Config{ClientCert: ca}); err == nil {
+		t.Error("expected an error for a client certificate without a key")
+	}
+}
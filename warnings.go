@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"bazil.org/fuse/fs"
+)
+
+// warningsInfo is the content of a warnings sibling file.
+type warningsInfo struct {
+	RequestID string   `json:"request_id"`
+	Warnings  []string `json:"warnings"`
+}
+
+// lookupWarnings returns a read-only file holding the request ID and any
+// warnings of the response the secret at relpath was read from, such as
+// those Vault gives for deprecated paths.  Like the lease, it's taken from
+// the cached response where possible.
+func lookupWarnings(ctx context.Context, d *MountDir, relpath string) (fs.Node, error) {
+	sec, err := readSecret(ctx, d, relpath)
+	if err != nil {
+		return nil, err
+	}
+	info := warningsInfo{RequestID: sec.resp.RequestID, Warnings: sec.resp.Warnings}
+	if info.Warnings == nil {
+		info.Warnings = []string{}
+	}
+	b, err := d.fs.marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(d.fs, siblingPath(d, relpath, "warnings"), b), nil
+}